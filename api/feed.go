@@ -63,7 +63,7 @@ func monitor(reg *registry.Registry, feed *Feed) {
 				glog.Errorln(err)
 				continue
 			}
-			if _, err := queue.NewQueueItem(r, "Add Document", nil, id, "", "", strings.NewReader(form.Encode())); err != nil {
+			if _, err := queue.NewQueueItem(r, "Add Document", queue.Bulk, nil, id, "", "", strings.NewReader(form.Encode())); err != nil {
 				glog.Infoln("Queueing add document:", err)
 				continue
 			}
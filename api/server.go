@@ -8,7 +8,11 @@ import (
 	"github.com/donovanhide/superfastmatch/queue"
 	"github.com/donovanhide/superfastmatch/registry"
 	"github.com/golang/glog"
+	"io"
+	"labix.org/v2/mgo"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 var r *registry.Registry
@@ -17,7 +21,11 @@ var c *posting.Client
 
 const docRegex = `[0-9]+`
 const queueRegex = `[0-9a-f]{24}`
-const rangeRegex = `\d+(-\d+)?(:\d+(-\d+)?)*`
+const themeRegex = `[0-9]+`
+
+// Groups must not capture, or the variables of a route following them are misnumbered
+const rangeRegex = `\d+(?:-\d+)?(?::\d+(?:-\d+)?)*`
+const selectorRegex = `\d+(?:-\d+)?(?:/\d+(?:-\d+)?(?:,\d+(?:-\d+)?)*)?(?::\d+(?:-\d+)?(?:/\d+(?:-\d+)?(?:,\d+(?:-\d+)?)*)?)*`
 
 type is []interface{}
 type ss []string
@@ -30,17 +38,44 @@ var routes = []struct {
 }{
 	{"/document/", nil, documentsHandler, ss{"GET", "DELETE"}},
 	{"/document/test/", nil, testHandler, ss{"POST"}},
-	{"/document/{doctypes:%s}/", is{rangeRegex}, documentsHandler, ss{"GET", "DELETE"}},
-	{"/document/{doctype:%s}/{docid:%s}/", is{docRegex, docRegex}, documentHandler, ss{"GET", "POST", "DELETE"}},
+	{"/document/repeats/", nil, findRepeatsHandler, ss{"POST"}},
+	{"/document/bulk/", nil, bulkHandler, ss{"POST"}},
+	{"/document/{doctype:%s}/{docid:%s}/", is{docRegex, docRegex}, documentHandler, ss{"GET", "POST", "PUT", "DELETE"}},
+	{"/document/{doctype:%s}/{docid:%s}/repeats/", is{docRegex, docRegex}, repeatsHandler, ss{"GET"}},
+	{"/document/{doctype:%s}/{docid:%s}/provenance/", is{docRegex, docRegex}, provenanceHandler, ss{"GET"}},
+	{"/document/{doctypes:%s}/", is{selectorRegex}, documentsHandler, ss{"GET", "DELETE"}},
+	{"/document/{doctypes:%s}/repeats/", is{rangeRegex}, findRepeatsHandler, ss{"POST"}},
 	{"/association/", nil, associationHandler, ss{"GET", "POST", "DELETE"}},
+	{"/association/export/", nil, exportHandler, ss{"GET"}},
 	{"/association/{source:%s}/", is{rangeRegex}, associationHandler, ss{"GET", "POST", "DELETE"}},
-	{"/association/{source:%s}/{target:%s}/", is{rangeRegex, rangeRegex}, associationHandler, ss{"GET", "POST", "DELETE"}},
 	{"/association/{doctype:%s}/{docid:%s}/{target:%s}/", is{docRegex, docRegex, rangeRegex}, associationHandler, ss{"POST"}},
+	{"/association/{source:%s}/{target:%s}/", is{selectorRegex, selectorRegex}, associationHandler, ss{"GET", "POST", "DELETE"}},
+	{"/theme/", nil, themesHandler, ss{"GET"}},
+	{"/theme/{id:%s}/", is{themeRegex}, themeHandler, ss{"GET"}},
+	{"/cluster/", nil, clustersHandler, ss{"GET", "POST"}},
+	{"/cluster/{doctypes:%s}/", is{rangeRegex}, clustersHandler, ss{"GET", "POST"}},
+	{"/cluster/{doctype:%s}/{docid:%s}/", is{docRegex, docRegex}, clusterHandler, ss{"GET"}},
+	{"/ignore/", nil, ignoreHandler, ss{"GET", "POST"}},
+	{"/ignore/{id:%s}/", is{queueRegex}, ignoreHandler, ss{"DELETE"}},
 	{"/queue/", nil, queueHandler, ss{"GET"}},
-	{"/queue/{id:%s}/", is{queueRegex}, queueItemHandler, ss{"GET"}},
+	{"/queue/requeue/", nil, requeueHandler, ss{"POST"}},
+	{"/queue/pause/", nil, pauseHandler, ss{"POST"}},
+	{"/queue/resume/", nil, resumeHandler, ss{"POST"}},
+	{"/queue/{id:%s}/", is{queueRegex}, queueItemHandler, ss{"GET", "DELETE"}},
+	{"/queue/{id:%s}/acknowledge/", is{queueRegex}, acknowledgeHandler, ss{"POST"}},
 	{"/index/", nil, indexHandler, ss{"GET"}},
+	{"/index/reindex/", nil, reindexHandler, ss{"POST"}},
+	{"/index/reindex/{doctypes:%s}/", is{rangeRegex}, reindexHandler, ss{"POST"}},
 	{"/search/", nil, searchHandler, ss{"POST"}},
-	{"/search/{target:%s}/", is{rangeRegex}, searchHandler, ss{"POST"}},
+	{"/search/{target:%s}/", is{selectorRegex}, searchHandler, ss{"POST"}},
+	{"/duplicates/", nil, duplicatesHandler, ss{"POST"}},
+	{"/duplicates/{doctype:%s}/{docid:%s}/", is{docRegex, docRegex}, duplicatesHandler, ss{"GET"}},
+	{"/compare/", nil, compareHandler, ss{"POST"}},
+	{"/compare/{doctype:%s}/{docid:%s}/", is{docRegex, docRegex}, compareHandler, ss{"POST"}},
+}
+
+type SuccessResponse struct {
+	Success bool `json:"success"`
 }
 
 type QueuedResponse struct {
@@ -49,13 +84,22 @@ type QueuedResponse struct {
 }
 
 func testHandler(rw http.ResponseWriter, req *http.Request) *appError {
-	item, err := queue.NewQueueItem(r, "Test Corpus", nil, nil, "", "", req.Body)
+	item, err := queue.NewQueueItem(r, "Test Corpus", queuePriority(req), nil, nil, "", "", req.Body)
 	if err != nil {
 		return &appError{err, "Test Corpus Problem", 500}
 	}
 	return writeJson(rw, req, &QueuedResponse{Success: true, QueueItem: item}, 202)
 }
 
+// The body is either newline-delimited JSON or a tar archive with a manifest
+func bulkHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	item, err := queue.NewBulkItem(r, queuePriority(req), req.Body)
+	if err != nil {
+		return &appError{err, "Bulk add error", 500}
+	}
+	return writeJson(rw, req, &QueuedResponse{Success: true, QueueItem: item}, 202)
+}
+
 func documentsHandler(rw http.ResponseWriter, req *http.Request) *appError {
 	fillValues(req)
 	switch req.Method {
@@ -65,6 +109,28 @@ func documentsHandler(rw http.ResponseWriter, req *http.Request) *appError {
 			return &appError{err, "Document not found", 404}
 		}
 		return writeJson(rw, req, documents, 200)
+	case "DELETE":
+		// A range is required, so that the whole corpus can't be deleted by
+		// accident. A dry run returns the number of documents which would be deleted.
+		doctypes := req.Form.Get("doctypes")
+		switch {
+		case doctypes == "":
+			return &appError{fmt.Errorf("No range of doctypes given"), "Delete documents error", 400}
+		case !document.DocTypeRange(doctypes).Valid():
+			return &appError{fmt.Errorf("Bad range: %s", doctypes), "Delete documents error", 400}
+		}
+		if dryRun, _ := strconv.ParseBool(req.Form.Get("dry_run")); dryRun {
+			result, err := document.CountDocuments(doctypes, r)
+			if err != nil {
+				return &appError{err, "Delete documents error", 500}
+			}
+			return writeJson(rw, req, result, 200)
+		}
+		item, err := queue.NewQueueItem(r, "Delete Documents", queuePriority(req), nil, nil, doctypes, "", req.Body)
+		if err != nil {
+			return &appError{err, "Delete documents error", 500}
+		}
+		return writeJson(rw, req, &QueuedResponse{Success: true, QueueItem: item}, 202)
 	}
 	return nil
 }
@@ -86,17 +152,27 @@ func documentHandler(rw http.ResponseWriter, req *http.Request) *appError {
 		if err != nil {
 			return &appError{err, "Add document error", 500}
 		}
-		item, err := queue.NewQueueItem(r, "Add Document", nil, target, "", "", req.Body)
+		item, err := queue.NewQueueItem(r, "Add Document", queuePriority(req), nil, target, "", "", req.Body)
 		if err != nil {
 			return &appError{err, "Add document error", 500}
 		}
 		return writeJson(rw, req, &QueuedResponse{Success: true, QueueItem: item}, 202)
+	case "PUT":
+		target, err := document.NewDocumentId(req)
+		if err != nil {
+			return &appError{err, "Update document error", 500}
+		}
+		item, err := queue.NewQueueItem(r, "Update Document", queuePriority(req), nil, target, "", "", req.Body)
+		if err != nil {
+			return &appError{err, "Update document error", 500}
+		}
+		return writeJson(rw, req, &QueuedResponse{Success: true, QueueItem: item}, 202)
 	case "DELETE":
 		target, err := document.NewDocumentId(req)
 		if err != nil {
 			return &appError{err, "Delete document error", 500}
 		}
-		item, err := queue.NewQueueItem(r, "Delete Document", nil, target, "", "", req.Body)
+		item, err := queue.NewQueueItem(r, "Delete Document", queuePriority(req), nil, target, "", "", req.Body)
 		if err != nil {
 			return &appError{err, "Delete document error", 500}
 		}
@@ -105,18 +181,55 @@ func documentHandler(rw http.ResponseWriter, req *http.Request) *appError {
 	return nil
 }
 
+func repeatsHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	id, err := document.NewDocumentId(req)
+	if err != nil {
+		return &appError{err, "Get repeats error", 500}
+	}
+	repeats, err := document.GetRepeats(id, r)
+	if err != nil {
+		return &appError{err, "Document not found", 404}
+	}
+	return writeJson(rw, req, repeats, 200)
+}
+
+func findRepeatsHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	item, err := queue.NewQueueItem(r, "Find Repeats", queuePriority(req), nil, nil, mux.Vars(req)["doctypes"], "", req.Body)
+	if err != nil {
+		return &appError{err, "Find repeats error", 500}
+	}
+	return writeJson(rw, req, &QueuedResponse{Success: true, QueueItem: item}, 202)
+}
+
 func associationHandler(rw http.ResponseWriter, req *http.Request) *appError {
 	fillValues(req)
+	for _, key := range []string{"source", "target"} {
+		if value := req.Form.Get(key); !document.DocTypeRange(value).Valid() {
+			return &appError{fmt.Errorf("Bad %s range: %s", key, value), "Association error", 400}
+		}
+	}
 	switch req.Method {
 	case "GET":
-		associations := make([]document.Association, 0)
+		associations, err := document.GetAssociations(&req.Form, r)
+		if err != nil {
+			return &appError{err, "Association problem", 500}
+		}
 		return writeJson(rw, req, associations, 200)
 	case "DELETE":
-		return nil
+		// Without a source range every association would be deleted
+		if req.Form.Get("source") == "" {
+			return &appError{fmt.Errorf("No source range given"), "Association error", 400}
+		}
+		result, err := document.DeleteAssociations(&req.Form, r)
+		if err != nil {
+			return &appError{err, "Association problem", 500}
+		}
+		return writeJson(rw, req, result, 200)
 	case "POST":
 		source, _ := document.NewDocumentId(req)
 		sourceRange, targetRange := mux.Vars(req)["source"], mux.Vars(req)["target"]
-		item, err := queue.NewQueueItem(r, "Associate Document", source, nil, sourceRange, targetRange, req.Body)
+		// The body has already been parsed into the form, which carries any exclusions
+		item, err := queue.NewQueueItem(r, "Associate Document", queuePriority(req), source, nil, sourceRange, targetRange, strings.NewReader(req.Form.Encode()))
 		if err != nil {
 			return &appError{err, "Association error", 500}
 		}
@@ -125,8 +238,141 @@ func associationHandler(rw http.ResponseWriter, req *http.Request) *appError {
 	return nil
 }
 
+func exportHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	fillValues(req)
+	export, err := document.NewAssociationExport(&req.Form)
+	if err != nil {
+		return &appError{err, "Export problem", 400}
+	}
+	return writeStream(rw, req, export.ContentType(), func(w io.Writer) error {
+		return export.Write(w, r)
+	})
+}
+
+func themesHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	fillValues(req)
+	themes, err := document.GetThemes(&req.Form, r)
+	if err != nil {
+		return &appError{err, "Theme problem", 500}
+	}
+	return writeJson(rw, req, themes, 200)
+}
+
+func themeHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	fillValues(req)
+	id, err := document.NewThemeId(req.Form.Get("id"))
+	if err != nil {
+		return &appError{err, "Bad theme id", 400}
+	}
+	theme, err := document.GetTheme(id, r)
+	if err != nil {
+		return &appError{err, "Theme not found", 404}
+	}
+	return writeJson(rw, req, theme, 200)
+}
+
+func clustersHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	switch req.Method {
+	case "GET":
+		fillValues(req)
+		if doctypes := req.Form.Get("doctypes"); doctypes != "" {
+			req.Form.Set("range", doctypes)
+		}
+		clusters, err := document.GetClusters(&req.Form, r)
+		if err != nil {
+			return &appError{err, "Cluster problem", 500}
+		}
+		return writeJson(rw, req, clusters, 200)
+	case "POST":
+		item, err := queue.NewQueueItem(r, "Cluster Documents", queuePriority(req), nil, nil, mux.Vars(req)["doctypes"], "", req.Body)
+		if err != nil {
+			return &appError{err, "Cluster documents error", 500}
+		}
+		return writeJson(rw, req, &QueuedResponse{Success: true, QueueItem: item}, 202)
+	}
+	return nil
+}
+
+func clusterHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	id, err := document.NewDocumentId(req)
+	if err != nil {
+		return &appError{err, "Get cluster error", 500}
+	}
+	clusters, err := document.GetDocumentClusters(id, r)
+	if err != nil {
+		return &appError{err, "Cluster problem", 500}
+	}
+	return writeJson(rw, req, clusters, 200)
+}
+
+func provenanceHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	fillValues(req)
+	id, err := document.NewDocumentId(req)
+	if err != nil {
+		return &appError{err, "Get provenance error", 500}
+	}
+	provenance, err := document.GetProvenance(id, &req.Form, r)
+	if err != nil {
+		return &appError{err, "Document not found", 404}
+	}
+	return writeJson(rw, req, provenance, 200)
+}
+
+func ignoreHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	fillValues(req)
+	switch req.Method {
+	case "GET":
+		ignores, err := document.GetIgnores(&req.Form, r)
+		if err != nil {
+			return &appError{err, "Ignore problem", 500}
+		}
+		return writeJson(rw, req, ignores, 200)
+	case "POST":
+		ignore, err := document.NewIgnore(r, &req.Form)
+		if err != nil {
+			return &appError{err, "Add ignore error", 500}
+		}
+		if err := reloadIgnores(); err != nil {
+			return err
+		}
+		return writeJson(rw, req, ignore, 201)
+	case "DELETE":
+		if err := document.DeleteIgnore(r, req.Form.Get("id")); err != nil {
+			return &appError{err, "Ignore not found", 404}
+		}
+		if err := reloadIgnores(); err != nil {
+			return err
+		}
+		return writeJson(rw, req, &SuccessResponse{Success: true}, 200)
+	}
+	return nil
+}
+
+// The API and every posting server keep their own copy of the ignored passages.
+// Queue workers in other processes pick up the change from the stored version.
+func reloadIgnores() *appError {
+	if err := document.LoadIgnores(r); err != nil {
+		return &appError{err, "Reload ignores error", 500}
+	}
+	reload := true
+	if err := c.CallMultiple("Posting.LoadIgnores", &reload); err != nil {
+		return &appError{err, "Reload ignores error", 500}
+	}
+	return nil
+}
+
 func queueItemHandler(rw http.ResponseWriter, req *http.Request) *appError {
 	fillValues(req)
+	if req.Method == "DELETE" {
+		item, err := queue.CancelQueueItem(req.Form, r)
+		switch {
+		case err == queue.ErrNotCancellable:
+			return &appError{err, "Queue item not cancelled", 409}
+		case err != nil:
+			return &appError{err, "Queue item not found", 404}
+		}
+		return writeJson(rw, req, item, 200)
+	}
 	item, err := queue.GetQueueItem(req.Form, r)
 	if err != nil {
 		return &appError{err, "Queue problem", 500}
@@ -137,30 +383,84 @@ func queueItemHandler(rw http.ResponseWriter, req *http.Request) *appError {
 			rw.Header().Set("Location", location)
 		}
 		return writeJson(rw, req, item, 201)
-	case "Failed":
+	case "Failed", "Dead", "Cancelled":
 		return writeJson(rw, req, item, 400)
 	}
 	return writeJson(rw, req, item, 202)
 }
 
+// Failed items are kept until acknowledged
+func acknowledgeHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	fillValues(req)
+	item, err := queue.AcknowledgeQueueItem(req.Form, r)
+	if err != nil {
+		return &appError{err, "Queue item not acknowledged", 404}
+	}
+	return writeJson(rw, req, item, 200)
+}
+
+// Pausing stops every worker claiming new items
+func pauseHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	result, err := queue.SetPaused(r, true)
+	if err != nil {
+		return &appError{err, "Queue problem", 500}
+	}
+	return writeJson(rw, req, result, 200)
+}
+
+func resumeHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	result, err := queue.SetPaused(r, false)
+	if err != nil {
+		return &appError{err, "Queue problem", 500}
+	}
+	return writeJson(rw, req, result, 200)
+}
+
 func queueHandler(rw http.ResponseWriter, req *http.Request) *appError {
 	fillValues(req)
-	rows, err := queue.GetQueue(req.Form, r)
+	query, err := queue.NewQueueQuery(req.Form)
+	if err != nil {
+		return &appError{err, "Queue problem", 400}
+	}
+	rows, err := query.GetQueue(r)
 	if err != nil {
 		return &appError{err, "Queue problem", 500}
 	}
 	return writeJson(rw, req, rows, 200)
 }
 
+func requeueHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	fillValues(req)
+	result, err := queue.Requeue(req.Form, r)
+	if err != nil {
+		return &appError{err, "Requeue problem", 500}
+	}
+	return writeJson(rw, req, result, 200)
+}
+
 func indexHandler(rw http.ResponseWriter, req *http.Request) *appError {
 	fillValues(req)
-	rows, err := c.GetRows(&req.Form)
+	index, err := r.Index(req.Form.Get("index"))
+	if err != nil {
+		return &appError{err, "Index problem", 400}
+	}
+	rows, err := c.GetRows(index, &req.Form)
 	if err != nil {
 		return &appError{err, "Index problem", 500}
 	}
 	return writeJson(rw, req, rows, 200)
 }
 
+// Rebuilds the posting servers for a range, or for every document. A body of
+// shadow=true keeps searches working during the rebuild.
+func reindexHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	item, err := queue.NewQueueItem(r, "Reindex", queuePriority(req), nil, nil, mux.Vars(req)["doctypes"], "", req.Body)
+	if err != nil {
+		return &appError{err, "Reindex error", 500}
+	}
+	return writeJson(rw, req, &QueuedResponse{Success: true, QueueItem: item}, 202)
+}
+
 func searchHandler(rw http.ResponseWriter, req *http.Request) *appError {
 	fillValues(req)
 	search, err := document.NewDocumentArg(r, req.Form)
@@ -178,6 +478,70 @@ func searchHandler(rw http.ResponseWriter, req *http.Request) *appError {
 	return writeJson(rw, req, result, 200)
 }
 
+func duplicatesHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	fillValues(req)
+	var doc *document.Document
+	var err error
+	switch req.Method {
+	case "GET":
+		id, err := document.NewDocumentId(req)
+		if err != nil {
+			return &appError{err, "Duplicates problem", 400}
+		}
+		if doc, err = document.GetDocument(id, r); err != nil {
+			return &appError{err, "Document not found", 404}
+		}
+	case "POST":
+		if doc, err = document.BuildDocument(0, 0, "", req.Form.Get("text"), nil); err != nil {
+			return &appError{err, "Duplicates problem", 400}
+		}
+		if doc.Length < r.WindowSize {
+			return &appError{&document.LengthError{Field: "text", WindowSize: r.WindowSize}, "Duplicates problem", 400}
+		}
+	}
+	threshold := document.NewDuplicateThreshold(req.Form.Get("threshold"))
+	result, err := document.FindDuplicates(r, doc, threshold)
+	if err != nil {
+		return &appError{err, "Duplicates problem", 500}
+	}
+	return writeJson(rw, req, result, 200)
+}
+
+func compareHandler(rw http.ResponseWriter, req *http.Request) *appError {
+	fillValues(req)
+	var id *document.DocumentID
+	if _, ok := mux.Vars(req)["doctype"]; ok {
+		var err error
+		if id, err = document.NewDocumentId(req); err != nil {
+			return &appError{err, "Compare Arguments", 400}
+		}
+	}
+	compare, err := document.NewCompareArg(r, id, req.Form)
+	if err != nil {
+		return &appError{err, "Compare Arguments", 400}
+	}
+	result, err := document.Compare(r, compare)
+	switch _, short := err.(*document.LengthError); {
+	case err == nil:
+		return writeJson(rw, req, result, 200)
+	case short:
+		return &appError{err, "Compare Documents", 400}
+	case err == mgo.ErrNotFound:
+		return &appError{err, "Compare Documents", 404}
+	}
+	return &appError{err, "Compare Documents", 500}
+}
+
+// Routes are matched in order, so single documents come before selectors, which may also contain slashes
+func newRouter() *mux.Router {
+	router := mux.NewRouter().StrictSlash(true)
+	for _, r := range routes {
+		path := fmt.Sprintf(r.path, r.regexes...)
+		router.Handle(path, appHandler(r.fn)).Methods(r.methods...)
+	}
+	return router
+}
+
 func Serve(registry *registry.Registry) {
 	r = registry
 	var err error
@@ -186,11 +550,18 @@ func Serve(registry *registry.Registry) {
 		panic(err)
 	}
 	defer c.Close()
-	router := mux.NewRouter().StrictSlash(true)
-	for _, r := range routes {
-		path := fmt.Sprintf(r.path, r.regexes...)
-		router.Handle(path, appHandler(r.fn)).Methods(r.methods...)
+	switch missing, err := document.SignaturesMissing(registry); {
+	case err != nil:
+		glog.Errorln("Checking signatures:", err)
+	case missing:
+		if _, err := queue.NewQueueItem(registry, "Fill Signatures", queue.DefaultPriority, nil, nil, "", "", strings.NewReader("")); err != nil {
+			glog.Errorln("Queueing signatures:", err)
+		}
+	}
+	if err := document.LoadIgnores(registry); err != nil {
+		glog.Errorln("Loading ignores:", err)
 	}
+	router := newRouter()
 	glog.Infoln("Starting API server on:", registry.ApiListener.Addr().String())
 	registry.Routines.Add(1)
 	http.Serve(registry.ApiListener, router)
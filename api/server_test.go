@@ -0,0 +1,127 @@
+package api
+
+import (
+	"github.com/donovanhide/mux"
+	"github.com/donovanhide/superfastmatch/registry"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ServerSuite struct{}
+
+var _ = Suite(&ServerSuite{})
+
+func (s *ServerSuite) TestDeleteDocumentsRange(c *C) {
+	for _, path := range []string{"/document/", "/document/?doctypes=", "/document/?doctypes=1-", "/document/?doctypes=a:b&dry_run=true"} {
+		req, err := http.NewRequest("DELETE", path, nil)
+		c.Assert(err, IsNil)
+		e := documentsHandler(httptest.NewRecorder(), req)
+		c.Assert(e, NotNil, Commentf(path))
+		c.Check(e.Code, Equals, 400, Commentf(path))
+	}
+}
+
+func (s *ServerSuite) TestBadThemeId(c *C) {
+	req, err := http.NewRequest("GET", "/theme/?id=99999999999999999999", nil)
+	c.Assert(err, IsNil)
+	e := themeHandler(httptest.NewRecorder(), req)
+	c.Assert(e, NotNil)
+	c.Check(e.Code, Equals, 400)
+}
+
+func (s *ServerSuite) TestAssociationRanges(c *C) {
+	for _, test := range []struct{ method, path string }{
+		{"GET", "/association/?source=1-"},
+		{"POST", "/association/?target=a"},
+		{"DELETE", "/association/"},
+		{"DELETE", "/association/?target=2"},
+	} {
+		req, err := http.NewRequest(test.method, test.path, nil)
+		c.Assert(err, IsNil)
+		e := associationHandler(httptest.NewRecorder(), req)
+		c.Assert(e, NotNil, Commentf(test.path))
+		c.Check(e.Code, Equals, 400, Commentf(test.path))
+	}
+}
+
+func (s *ServerSuite) TestSelectorRoutes(c *C) {
+	router := newRouter()
+	for _, test := range []struct {
+		method, path string
+		vars         map[string]string
+	}{
+		{"GET", "/document/1/2/", map[string]string{"doctype": "1", "docid": "2"}},
+		{"GET", "/document/1/2-5,9:3/", map[string]string{"doctypes": "1/2-5,9:3"}},
+		{"DELETE", "/document/1-2/", map[string]string{"doctypes": "1-2"}},
+		{"GET", "/association/1/2/", map[string]string{"source": "1", "target": "2"}},
+		{"GET", "/association/1/2-3/4/5,6/", map[string]string{"source": "1/2-3", "target": "4/5,6"}},
+		{"POST", "/association/1/2/3/", map[string]string{"doctype": "1", "docid": "2", "target": "3"}},
+	} {
+		req, err := http.NewRequest(test.method, test.path, nil)
+		c.Assert(err, IsNil)
+		var match mux.RouteMatch
+		c.Assert(router.Match(req, &match), Equals, true, Commentf(test.path))
+		c.Check(match.Vars, DeepEquals, test.vars, Commentf(test.path))
+	}
+}
+
+func (s *ServerSuite) TestCompareArguments(c *C) {
+	defer func(registry *registry.Registry) { r = registry }(r)
+	r = &registry.Registry{WindowSize: 30}
+	router := newRouter()
+	long := strings.Repeat("long enough text ", 5)
+	for _, test := range []struct {
+		path string
+		form url.Values
+	}{
+		{"/compare/", url.Values{"text": {long}}},
+		{"/compare/", url.Values{"text": {"short"}, "other": {long}}},
+		{"/compare/0/1/", url.Values{"text": {long}}},
+		{"/compare/1/99999999999/", url.Values{"text": {long}}},
+	} {
+		req, err := http.NewRequest("POST", test.path, strings.NewReader(test.form.Encode()))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		c.Check(rw.Code, Equals, 400, Commentf(test.path))
+	}
+}
+
+func (s *ServerSuite) TestDuplicatesArguments(c *C) {
+	defer func(registry *registry.Registry) { r = registry }(r)
+	r = &registry.Registry{WindowSize: 30}
+	router := newRouter()
+	for _, test := range []struct {
+		method string
+		path   string
+		form   url.Values
+	}{
+		{"POST", "/duplicates/", url.Values{"text": {"short"}}},
+		{"POST", "/duplicates/", url.Values{}},
+		{"GET", "/duplicates/0/1/", nil},
+	} {
+		req, err := http.NewRequest(test.method, test.path, strings.NewReader(test.form.Encode()))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		c.Check(rw.Code, Equals, 400, Commentf(test.path))
+	}
+}
+
+func (s *ServerSuite) TestUnknownIndex(c *C) {
+	defer func(registry *registry.Registry) { r = registry }(r)
+	r = &registry.Registry{Indexes: []registry.IndexConfig{{Name: registry.DefaultIndex}}}
+	req, err := http.NewRequest("GET", "/index/?index=missing", nil)
+	c.Assert(err, IsNil)
+	e := indexHandler(httptest.NewRecorder(), req)
+	c.Assert(e, NotNil)
+	c.Check(e.Code, Equals, 400)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/donovanhide/mux"
+	"github.com/donovanhide/superfastmatch/queue"
 	"github.com/golang/glog"
 	"io"
 	"net/http"
@@ -57,9 +58,39 @@ func writeJson(rw http.ResponseWriter, req *http.Request, object interface{}, co
 	return nil
 }
 
+// Headers are sent before f is called, so errors can only be logged
+func writeStream(rw http.ResponseWriter, req *http.Request, contentType string, f func(io.Writer) error) *appError {
+	var w io.Writer = rw
+	if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		gz, err := gzip.NewWriterLevel(rw, gzip.BestSpeed)
+		if err != nil {
+			return &appError{err, "Gzip Error", 500}
+		}
+		rw.Header().Set("Content-Encoding", "gzip")
+		w = gz
+		defer gz.Close()
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.WriteHeader(200)
+	if err := f(w); err != nil {
+		glog.Errorf("Stream Error: %v", err)
+	}
+	return nil
+}
+
 func fillValues(req *http.Request) {
 	req.ParseForm()
 	for k, v := range mux.Vars(req) {
 		req.Form.Add(k, v)
 	}
 }
+
+// Queued commands take an optional priority parameter in the url, otherwise
+// the command's default is used.
+func queuePriority(req *http.Request) queue.Priority {
+	priority, err := queue.ParsePriority(req.URL.Query().Get("priority"))
+	if err != nil {
+		glog.Warningln(err)
+	}
+	return priority
+}
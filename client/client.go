@@ -1,6 +1,7 @@
 package client
 
 import (
+	"code.google.com/p/go.exp/utf8string"
 	"flag"
 	"fmt"
 	"github.com/donovanhide/superfastmatch/api"
@@ -31,7 +32,7 @@ func Run(args []string) {
 	c := make(chan *api.QueuedResponse, 100)
 	var cmd command
 	done := PollQueue(c)
-	usage := "Actions available: add delete search associate"
+	usage := "Actions available: add delete search compare associate"
 	set.Usage = func() {
 		fmt.Println(usage)
 		set.PrintDefaults()
@@ -53,6 +54,9 @@ func Run(args []string) {
 		case "search":
 			cmd = searchCommand
 			usage = "Search for matching documents\nsuperfastmatch client search file/dir/archive/pipe"
+		case "compare":
+			cmd = compareCommand
+			usage = "Compare two files without adding them\nsuperfastmatch client compare file file"
 		}
 	}
 	if len(args) <= 1 || set.Parse(args[1:]) == flag.ErrHelp {
@@ -129,6 +133,48 @@ func search(text string) {
 	out.Flush()
 }
 
+func compareCommand(c chan *api.QueuedResponse) {
+	if set.NArg() != 2 {
+		set.Usage()
+		return
+	}
+	text, err := readFile(set.Arg(0))
+	if err != nil {
+		fmt.Println("Compare:", err)
+		return
+	}
+	other, err := readFile(set.Arg(1))
+	if err != nil {
+		fmt.Println("Compare:", err)
+		return
+	}
+	compare(text, other)
+}
+
+func compare(text, other string) {
+	apiUrl := fmt.Sprintf("http://%s/compare/", flags.apiAddress)
+	var result document.CompareResult
+	form := make(url.Values)
+	form.Add("text", text)
+	form.Add("other", other)
+	code, err := doPost(apiUrl, form, &result)
+	switch {
+	case err != nil:
+		fmt.Println("Compare:", err)
+	case code == http.StatusOK:
+		left := utf8string.NewString(text)
+		for _, f := range result.Fragments {
+			fmt.Fprint(out, f.Pretty(60, left))
+		}
+		cov := result.Coverage
+		fmt.Fprintf(out, "Fragments: %d\tThemes: %d\tLeft: %d (%.2f%%)\tRight: %d (%.2f%%)\n",
+			len(result.Fragments), len(result.Themes), cov.Left, cov.LeftRatio*100, cov.Right, cov.RightRatio*100)
+	case code != http.StatusOK:
+		fmt.Println(code)
+	}
+	out.Flush()
+}
+
 func addFile(c chan *api.QueuedResponse) fileFn {
 	var lastPath string
 	firstTitle := true
@@ -185,6 +231,7 @@ func PollQueue(c chan *api.QueuedResponse) chan bool {
 		for item := range c {
 			apiUrl := fmt.Sprintf("http://%s/queue/%s/", flags.apiAddress, item.Id.Hex())
 			var queueItem queue.QueueItem
+			var progress string
 			code, err := doRequest("GET", apiUrl, &queueItem)
 		poll:
 			for {
@@ -197,6 +244,10 @@ func PollQueue(c chan *api.QueuedResponse) chan bool {
 				case code == http.StatusBadRequest:
 					failures = append(failures, queueItem)
 				default:
+					if queueItem.Progress != nil && queueItem.Progress.String() != progress {
+						progress = queueItem.Progress.String()
+						fmt.Printf("%s %s: %s\n", queueItem.Command, queueItem.Id.Hex(), progress)
+					}
 					time.Sleep(time.Second)
 					continue poll
 				}
@@ -67,6 +67,26 @@ func getFile(path string) (io.ReadCloser, os.FileInfo, error) {
 	return io.ReadCloser(f), fi, nil
 }
 
+// Returns the text of the first file found at path, decompressing if necessary
+func readFile(path string) (string, error) {
+	r, fi, err := getFile(path)
+	if err != nil {
+		return "", err
+	}
+	var text []byte
+	f := func(path string, fi os.FileInfo, r io.Reader) error {
+		if text != nil {
+			return nil
+		}
+		text, err = ioutil.ReadAll(r)
+		return err
+	}
+	if err := processFile(path, fi, r, f); err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
 func startWalk(path string, f fileFn) {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
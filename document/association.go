@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"code.google.com/p/go.exp/utf8string"
 	"fmt"
+	"github.com/donovanhide/superfastmatch/registry"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/url"
 	"sync"
 )
 
@@ -16,11 +20,45 @@ type InvertedSlice []Inverted
 
 type Association struct {
 	Document
+	Fragments     FragmentSlice     `json:"fragments"`
+	FragmentCount int               `json:"fragment_count"`
+	Coverage      Coverage          `json:"coverage"`
+	Offsets       []FragmentOffsets `json:"offsets,omitempty" bson:"-"`
+}
+
+type AssociationSlice []Association
+
+type AssociationID struct {
+	Source DocumentID `json:"source"`
+	Target DocumentID `json:"target"`
+}
+
+// An association as stored in its own collection
+type AssociationRecord struct {
+	Id            AssociationID `json:"id" bson:"_id"`
+	Title         string        `json:"title"`
 	Fragments     FragmentSlice `json:"fragments"`
 	FragmentCount int           `json:"fragment_count"`
+	Coverage      Coverage      `json:"coverage"`
 }
 
-type AssociationSlice []Association
+type AssociationQueryParams struct {
+	QueryParams
+	Source            DocTypeRange `schema:"source"`
+	Target            DocTypeRange `schema:"target"`
+	MinCoverage       float64      `schema:"min_coverage"`
+	MinTargetCoverage float64      `schema:"min_target_coverage"`
+}
+
+type AssociationResult struct {
+	Rows      []AssociationRecord `json:"rows"`
+	TotalRows int                 `json:"totalRows"`
+}
+
+type AssociationDeleteResult struct {
+	Success bool `json:"success"`
+	Removed int  `json:"removed"`
+}
 
 type Associations struct {
 	Meta      MetaMap
@@ -115,19 +153,157 @@ func Common(doc, other *Document, hashKey HashKey) *Pairs {
 	return left.Merge(right)
 }
 
-func BuildAssociation(windowSize uint64, left *Document, right *Document) (*Association, ThemeMap) {
-	var themes ThemeMap
-	var fragments FragmentSlice
-	hashKey := HashKey{
+func associationHashKey(windowSize uint64) HashKey {
+	return HashKey{
 		WindowSize: windowSize - 3, // Tunable! This helps eliminate false matches
 		HashWidth:  32,             // Tunable! Wider the better!
 	}
+}
+
+func BuildAssociation(windowSize uint64, left *Document, right *Document) (*Association, ThemeMap) {
+	var themes ThemeMap
+	var fragments FragmentSlice
+	hashKey := associationHashKey(windowSize)
 	pairs := Common(left, right, hashKey)
 	fragments, themes = pairs.BuildFragments(left, int(hashKey.WindowSize), int(windowSize))
+	fragments, themes = ignores.filter(hashKey, left, right, fragments, themes)
 	right.Associations = nil
 	return &Association{
 		Document:      *right,
 		Fragments:     fragments,
 		FragmentCount: len(fragments),
+		Coverage:      fragments.Coverage(left, right),
 	}, themes
 }
+
+func (a *Association) Record(source DocumentID) *AssociationRecord {
+	return &AssociationRecord{
+		Id:            AssociationID{Source: source, Target: a.Id},
+		Title:         a.Title,
+		Fragments:     a.Fragments,
+		FragmentCount: a.FragmentCount,
+		Coverage:      a.Coverage,
+	}
+}
+
+// Replaces any previously stored association between source and the
+// associated document. Associations without fragments are removed.
+func (a *Association) Save(registry *registry.Registry, source DocumentID) error {
+	record := a.Record(source)
+	db := registry.DB()
+	defer db.Session.Close()
+	associations := db.C("associations")
+	if record.FragmentCount == 0 {
+		if err := associations.RemoveId(record.Id); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	_, err := associations.UpsertId(record.Id, record)
+	return err
+}
+
+func (s AssociationSlice) find(id DocumentID) *Association {
+	for i := range s {
+		if s[i].Id == id {
+			return &s[i]
+		}
+	}
+	return nil
+}
+
+func (s AssociationSlice) remove(id DocumentID) AssociationSlice {
+	for i := range s {
+		if s[i].Id == id {
+			return append(s[:i], s[i+1:]...)
+		}
+	}
+	return s
+}
+
+// Removes the stored associations of the document with any target in the
+// range, so that a new run leaves none from an earlier one behind. The embedded
+// associations are only changed in memory, ready for the document to be saved.
+func (d *Document) clearAssociations(registry *registry.Registry, targetRange DocTypeRange) error {
+	query := bson.M{"_id.source": d.Id}
+	if len(targetRange) > 0 {
+		query = bson.M{"$and": []bson.M{query, targetRange.ParseField("_id.target.doctype")}}
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	if _, err := db.C("associations").RemoveAll(query); err != nil {
+		return err
+	}
+	target, kept := targetRange.Selector(), d.Associations[:0]
+	for _, a := range d.Associations {
+		if len(target) > 0 && !target.Contains(a.Id) {
+			kept = append(kept, a)
+		}
+	}
+	d.Associations = kept
+	return nil
+}
+
+func (q *AssociationQueryParams) rangeFilter(source, target string) bson.M {
+	filter := make([]bson.M, 0, 2)
+	if len(q.Source) > 0 {
+		filter = append(filter, q.Source.ParseField(source))
+	}
+	if len(q.Target) > 0 {
+		filter = append(filter, q.Target.ParseField(target))
+	}
+	if len(filter) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": filter}
+}
+
+func (q *AssociationQueryParams) filter() bson.M {
+	filter := q.rangeFilter("_id.source.doctype", "_id.target.doctype")
+	if q.MinCoverage > 0 {
+		filter["coverage.leftratio"] = bson.M{"$gte": q.MinCoverage}
+	}
+	if q.MinTargetCoverage > 0 {
+		filter["coverage.rightratio"] = bson.M{"$gte": q.MinTargetCoverage}
+	}
+	return filter
+}
+
+func GetAssociations(values *url.Values, registry *registry.Registry) (*AssociationResult, error) {
+	q := new(AssociationQueryParams)
+	r := new(AssociationResult)
+	decoder.Decode(q, *values)
+	q.Filter = q.filter()
+	q.DefaultSort = []string{"_id.source.doctype", "_id.source.docid", "-coverage.leftratio"}
+	db := registry.DB()
+	defer db.Session.Close()
+	associations := q.getQuery(values, db.C("associations"))
+	if err := associations.All(&r.Rows); err != nil {
+		return nil, err
+	}
+	if err := fillResult(r, associations); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Removes all associations between the source and target ranges, including
+// those embedded in the source documents.
+func DeleteAssociations(values *url.Values, registry *registry.Registry) (*AssociationDeleteResult, error) {
+	q := new(AssociationQueryParams)
+	decoder.Decode(q, *values)
+	db := registry.DB()
+	defer db.Session.Close()
+	info, err := db.C("associations").RemoveAll(q.rangeFilter("_id.source.doctype", "_id.target.doctype"))
+	if err != nil {
+		return nil, err
+	}
+	sources, pull := q.Source.Parse(), bson.M{"associations": q.Target.ParseField("document._id.doctype")}
+	if _, err := db.C("documents").UpdateAll(sources, bson.M{"$pull": pull}); err != nil {
+		return nil, err
+	}
+	return &AssociationDeleteResult{
+		Success: true,
+		Removed: info.Removed,
+	}, nil
+}
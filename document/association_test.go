@@ -9,6 +9,13 @@ type AssociationSuite struct {
 	testutils.DBSuite
 }
 
+// Associations saved to and queried from the database
+type SavedAssociationSuite struct {
+	testutils.DBSuite
+}
+
+var _ = Suite(&SavedAssociationSuite{})
+
 func testIsSymmetric(windowSize uint64, left, right string, c *C) {
 	doc1, _ := BuildDocument(0, 0, left[:20], left, nil)
 	doc2, _ := BuildDocument(0, 0, right[:20], right, nil)
@@ -36,3 +43,44 @@ func (s *AssociationSuite) TestRealAssociation(c *C) {
 	testWithSelf(30, 108147, 13987, bible, c)
 	testWithSelf(30, 25414, 2152, koran, c)
 }
+
+func (s *SavedAssociationSuite) TestAssociations(c *C) {
+	text := RandomWords(200)
+	source, _ := BuildDocument(1, 1, "Source", text, nil)
+	c.Assert(source.Save(s.Registry), IsNil)
+	for i := uint32(1); i <= 3; i++ {
+		target, _ := BuildDocument(2, i, "Target", RandomWords(int(i)*100)+text, nil)
+		_, err := source.AddAssociation(s.Registry, target, true)
+		c.Assert(err, IsNil)
+		_, err = source.AddAssociation(s.Registry, target, true)
+		c.Assert(err, IsNil)
+	}
+	c.Check(len(source.Associations), Equals, 3)
+	values := buildValues("GET", "http://testing.com/?source=1&target=2", "")
+	results, err := GetAssociations(values, s.Registry)
+	c.Assert(err, IsNil)
+	c.Check(results.TotalRows, Equals, 3)
+	c.Check(results.Rows[0].Coverage.LeftRatio > 0.9, Equals, true)
+	values = buildValues("GET", "http://testing.com/?min_target_coverage=0.6", "")
+	results, err = GetAssociations(values, s.Registry)
+	c.Assert(err, IsNil)
+	c.Check(results.TotalRows, Equals, 1)
+	c.Assert(source.clearAssociations(s.Registry, "2/1-2"), IsNil)
+	c.Check(len(source.Associations), Equals, 1)
+	values = buildValues("GET", "http://testing.com/?source=1&target=2", "")
+	results, err = GetAssociations(values, s.Registry)
+	c.Assert(err, IsNil)
+	c.Check(results.TotalRows, Equals, 1)
+	c.Check(results.Rows[0].Id.Target, Equals, source.Associations[0].Id)
+	c.Assert(source.clearAssociations(s.Registry, "2"), IsNil)
+	c.Check(len(source.Associations), Equals, 0)
+	for i := uint32(1); i <= 3; i++ {
+		target, _ := BuildDocument(2, i, "Target", RandomWords(int(i)*100)+text, nil)
+		_, err := source.AddAssociation(s.Registry, target, true)
+		c.Assert(err, IsNil)
+	}
+	values = buildValues("DELETE", "http://testing.com/?source=1&target=2", "")
+	deleted, err := DeleteAssociations(values, s.Registry)
+	c.Assert(err, IsNil)
+	c.Check(deleted.Removed, Equals, 3)
+}
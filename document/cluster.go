@@ -0,0 +1,281 @@
+package document
+
+import (
+	"fmt"
+	"github.com/donovanhide/superfastmatch/registry"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultClusterThreshold = 0.8
+
+// Union-find over document ids
+type DisjointSet map[DocumentID]DocumentID
+
+type DocumentIDSlice []DocumentID
+
+func (s DocumentIDSlice) Len() int      { return len(s) }
+func (s DocumentIDSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s DocumentIDSlice) Less(i, j int) bool {
+	return s[i].Doctype < s[j].Doctype || (s[i].Doctype == s[j].Doctype && s[i].Docid < s[j].Docid)
+}
+
+// Documents within a doctype range are clustered when both sides of
+// their association cover at least the threshold.
+type Clustering struct {
+	Range     DocTypeRange `json:"range" bson:"_id"`
+	Threshold float64      `json:"threshold"`
+}
+
+// The representative is the member with the lowest id
+type Cluster struct {
+	Id             bson.ObjectId   `json:"id" bson:"_id"`
+	Range          DocTypeRange    `json:"range"`
+	Representative DocumentID      `json:"representative"`
+	Members        DocumentIDSlice `json:"members"`
+	Size           int             `json:"size"`
+}
+
+type ClusterQueryParams struct {
+	QueryParams
+	Range   DocTypeRange `schema:"range"`
+	MinSize int          `schema:"min_size"`
+}
+
+type ClusterResult struct {
+	Rows      []Cluster `json:"rows"`
+	TotalRows int       `json:"totalRows"`
+}
+
+func (c Coverage) Mutual() float64 {
+	if c.LeftRatio < c.RightRatio {
+		return c.LeftRatio
+	}
+	return c.RightRatio
+}
+
+func (s DisjointSet) Find(id DocumentID) DocumentID {
+	parent, ok := s[id]
+	if !ok {
+		s[id] = id
+		return id
+	}
+	if parent == id {
+		return id
+	}
+	root := s.Find(parent)
+	s[id] = root
+	return root
+}
+
+func (s DisjointSet) Union(a, b DocumentID) {
+	rootA, rootB := s.Find(a), s.Find(b)
+	if rootA != rootB {
+		s[rootB] = rootA
+	}
+}
+
+// Returns every set with more than one member
+func (s DisjointSet) Sets() []DocumentIDSlice {
+	roots := make(map[DocumentID]DocumentIDSlice)
+	for id := range s {
+		root := s.Find(id)
+		roots[root] = append(roots[root], id)
+	}
+	sets := make([]DocumentIDSlice, 0)
+	for _, members := range roots {
+		if len(members) > 1 {
+			sort.Sort(members)
+			sets = append(sets, members)
+		}
+	}
+	return sets
+}
+
+// A range selecting exactly the documents, eg. 1/2,3:4/5
+func (s DocumentIDSlice) Range() DocTypeRange {
+	ids := append(DocumentIDSlice{}, s...)
+	sort.Sort(ids)
+	sections := make([]string, 0)
+	for i := 0; i < len(ids); {
+		docids := make([]string, 0)
+		j := i
+		for ; j < len(ids) && ids[j].Doctype == ids[i].Doctype; j++ {
+			docids = append(docids, strconv.FormatUint(uint64(ids[j].Docid), 10))
+		}
+		sections = append(sections, fmt.Sprintf("%d/%s", ids[i].Doctype, strings.Join(docids, ",")))
+		i = j
+	}
+	return DocTypeRange(strings.Join(sections, ":"))
+}
+
+func NewClustering(docTypeRange string, values *url.Values) *Clustering {
+	threshold, err := strconv.ParseFloat(values.Get("threshold"), 64)
+	if err != nil || threshold <= 0 || threshold > 1 {
+		threshold = defaultClusterThreshold
+	}
+	return &Clustering{
+		Range:     DocTypeRange(docTypeRange),
+		Threshold: threshold,
+	}
+}
+
+func GetClusterings(registry *registry.Registry) ([]Clustering, error) {
+	var clusterings []Clustering
+	db := registry.DB()
+	defer db.Session.Close()
+	err := db.C("clusterings").Find(nil).All(&clusterings)
+	return clusterings, err
+}
+
+func (c *Clustering) Contains(id DocumentID) bool {
+	return len(c.Range) == 0 || c.Range.Selector().Contains(id)
+}
+
+// Joins source with every associated document above the threshold
+func (c *Clustering) Join(set DisjointSet, source DocumentID, associations AssociationSlice) {
+	set.Find(source)
+	for i := range associations {
+		a := &associations[i]
+		if a.Id != source && c.Contains(a.Id) && a.Coverage.Mutual() >= c.Threshold {
+			set.Union(source, a.Id)
+		}
+	}
+}
+
+func (c *Clustering) newCluster(members DocumentIDSlice) *Cluster {
+	sort.Sort(members)
+	return &Cluster{
+		Id:             bson.NewObjectId(),
+		Range:          c.Range,
+		Representative: members[0],
+		Members:        members,
+		Size:           len(members),
+	}
+}
+
+// Replaces all clusters for the range with those found in set
+func (c *Clustering) Replace(registry *registry.Registry, set DisjointSet) error {
+	db := registry.DB()
+	defer db.Session.Close()
+	if _, err := db.C("clusterings").UpsertId(c.Range, c); err != nil {
+		return err
+	}
+	clusters := db.C("clusters")
+	if _, err := clusters.RemoveAll(bson.M{"range": c.Range}); err != nil {
+		return err
+	}
+	for _, members := range set.Sets() {
+		if err := clusters.Insert(c.newCluster(members)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merges a newly associated document into the existing clusters it joins
+func (c *Clustering) Add(registry *registry.Registry, source DocumentID, associations AssociationSlice) error {
+	set := make(DisjointSet)
+	c.Join(set, source, associations)
+	ids := make(DocumentIDSlice, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	if len(ids) == 1 {
+		return nil
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	clusters := db.C("clusters")
+	var existing []Cluster
+	query := bson.M{"range": c.Range, "members": bson.M{"$in": ids}}
+	if err := clusters.Find(query).All(&existing); err != nil {
+		return err
+	}
+	for _, cluster := range existing {
+		for _, member := range cluster.Members {
+			set.Union(source, member)
+		}
+		if err := clusters.RemoveId(cluster.Id); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+	for _, members := range set.Sets() {
+		if err := clusters.Insert(c.newCluster(members)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the documents from the clusters they belong to, along with any
+// cluster left with a single member
+func removeClusterMembers(db *mgo.Database, ids []DocumentID) error {
+	clusters := db.C("clusters")
+	var affected []Cluster
+	if err := clusters.Find(bson.M{"members": bson.M{"$in": ids}}).All(&affected); err != nil {
+		return err
+	}
+	removed := make(map[DocumentID]bool, len(ids))
+	for _, id := range ids {
+		removed[id] = true
+	}
+	for _, cluster := range affected {
+		members := make(DocumentIDSlice, 0, len(cluster.Members))
+		for _, member := range cluster.Members {
+			if !removed[member] {
+				members = append(members, member)
+			}
+		}
+		var err error
+		if len(members) < 2 {
+			err = clusters.RemoveId(cluster.Id)
+		} else {
+			err = clusters.UpdateId(cluster.Id, bson.M{"$set": bson.M{"members": members, "size": len(members), "representative": members[0]}})
+		}
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetClusters(values *url.Values, registry *registry.Registry) (*ClusterResult, error) {
+	q := new(ClusterQueryParams)
+	r := new(ClusterResult)
+	decoder.Decode(q, *values)
+	q.Filter = bson.M{}
+	if len(q.Range) > 0 {
+		q.Filter["range"] = q.Range
+	}
+	if q.MinSize > 0 {
+		q.Filter["size"] = bson.M{"$gte": q.MinSize}
+	}
+	q.DefaultSort = []string{"-size"}
+	db := registry.DB()
+	defer db.Session.Close()
+	clusters := q.getQuery(values, db.C("clusters"))
+	if err := clusters.All(&r.Rows); err != nil {
+		return nil, err
+	}
+	if err := fillResult(r, clusters); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Returns every cluster the document is a member of
+func GetDocumentClusters(id *DocumentID, registry *registry.Registry) (*ClusterResult, error) {
+	r := new(ClusterResult)
+	db := registry.DB()
+	defer db.Session.Close()
+	if err := db.C("clusters").Find(bson.M{"members": id}).All(&r.Rows); err != nil {
+		return nil, err
+	}
+	r.TotalRows = len(r.Rows)
+	return r, nil
+}
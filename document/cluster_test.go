@@ -0,0 +1,76 @@
+package document
+
+import (
+	"github.com/donovanhide/superfastmatch/testutils"
+	. "launchpad.net/gocheck"
+)
+
+type ClusterSuite struct {
+	testutils.DBSuite
+}
+
+var _ = Suite(&ClusterSuite{})
+
+func (s *ClusterSuite) TestDisjointSet(c *C) {
+	set := make(DisjointSet)
+	ids := []DocumentID{{1, 1}, {1, 2}, {1, 3}, {2, 1}, {2, 2}, {3, 1}}
+	set.Union(ids[0], ids[1])
+	set.Union(ids[3], ids[4])
+	set.Union(ids[1], ids[4])
+	set.Find(ids[5])
+	c.Check(set.Find(ids[0]), Equals, set.Find(ids[4]))
+	c.Check(set.Find(ids[2]), Not(Equals), set.Find(ids[0]))
+	sets := set.Sets()
+	c.Assert(sets, HasLen, 1)
+	c.Check(sets[0], DeepEquals, DocumentIDSlice{{1, 1}, {1, 2}, {2, 1}, {2, 2}})
+}
+
+func (s *ClusterSuite) TestJoin(c *C) {
+	clustering := &Clustering{Range: "1-2", Threshold: 0.8}
+	source := DocumentID{1, 1}
+	associations := AssociationSlice{
+		{Document: Document{Id: source}, Coverage: Coverage{LeftRatio: 1, RightRatio: 1}},
+		{Document: Document{Id: DocumentID{1, 2}}, Coverage: Coverage{LeftRatio: 0.9, RightRatio: 0.85}},
+		{Document: Document{Id: DocumentID{1, 3}}, Coverage: Coverage{LeftRatio: 0.9, RightRatio: 0.5}},
+		{Document: Document{Id: DocumentID{3, 1}}, Coverage: Coverage{LeftRatio: 1, RightRatio: 1}},
+	}
+	set := make(DisjointSet)
+	clustering.Join(set, source, associations)
+	c.Check(set.Sets(), DeepEquals, []DocumentIDSlice{{{1, 1}, {1, 2}}})
+	c.Check(clustering.newCluster(DocumentIDSlice{{2, 1}, {1, 5}}).Representative, Equals, DocumentID{1, 5})
+}
+
+func (s *ClusterSuite) TestRange(c *C) {
+	ids := DocumentIDSlice{{2, 7}, {1, 3}, {1, 2}}
+	r := ids.Range()
+	c.Check(r, Equals, DocTypeRange("1/2,3:2/7"))
+	c.Check(r.Valid(), Equals, true)
+	for _, id := range ids {
+		c.Check(r.Selector().Contains(id), Equals, true)
+	}
+	c.Check(r.Selector().Contains(DocumentID{1, 4}), Equals, false)
+}
+
+func (s *ClusterSuite) TestRemoveClusterMembers(c *C) {
+	clustering := &Clustering{Range: "1", Threshold: 0.8}
+	ids := []DocumentID{{1, 1}, {1, 2}, {1, 3}, {1, 4}, {1, 5}}
+	set := make(DisjointSet)
+	set.Union(ids[0], ids[1])
+	set.Union(ids[1], ids[2])
+	set.Union(ids[3], ids[4])
+	c.Assert(clustering.Replace(s.Registry, set), IsNil)
+	_, err := DeleteDocuments(s.Registry, ids[:1])
+	c.Assert(err, IsNil)
+	clusters, err := GetDocumentClusters(&ids[1], s.Registry)
+	c.Assert(err, IsNil)
+	c.Assert(clusters.Rows, HasLen, 1)
+	c.Check(clusters.Rows[0].Members, DeepEquals, DocumentIDSlice{ids[1], ids[2]})
+	c.Check(clusters.Rows[0].Size, Equals, 2)
+	c.Check(clusters.Rows[0].Representative, Equals, ids[1])
+	doc, _ := BuildDocument(1, 4, "Member", RandomWords(100), nil)
+	c.Assert(doc.Save(s.Registry), IsNil)
+	c.Assert(doc.Delete(s.Registry), IsNil)
+	clusters, err = GetDocumentClusters(&ids[4], s.Registry)
+	c.Assert(err, IsNil)
+	c.Check(clusters.Rows, HasLen, 0)
+}
@@ -0,0 +1,91 @@
+package document
+
+import (
+	"fmt"
+	"github.com/donovanhide/superfastmatch/registry"
+	"net/url"
+	"unicode/utf8"
+)
+
+type CompareArg struct {
+	Id      *DocumentID
+	Text    string `schema:"text"`
+	Other   string `schema:"other"`
+	Offsets bool   `schema:"offsets"`
+}
+
+type CompareResult struct {
+	Success   bool              `json:"success"`
+	Fragments FragmentSlice     `json:"fragments"`
+	Themes    ThemeSlice        `json:"themes"`
+	Coverage  Coverage          `json:"coverage"`
+	Offsets   []FragmentOffsets `json:"offsets,omitempty"`
+}
+
+// A text which is too short to compare, as opposed to a document which can't be read
+type LengthError struct {
+	Field      string
+	WindowSize uint64
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("%s field less than %d unicode characters", e.Field, e.WindowSize)
+}
+
+func checkLength(registry *registry.Registry, field string, text string) error {
+	if uint64(utf8.RuneCountInString(text)) < registry.WindowSize {
+		return &LengthError{Field: field, WindowSize: registry.WindowSize}
+	}
+	return nil
+}
+
+// If id is not nil the stored document is compared with the text field,
+// otherwise the text and other fields are compared with each other.
+func NewCompareArg(registry *registry.Registry, id *DocumentID, values url.Values) (*CompareArg, error) {
+	c := &CompareArg{}
+	decoder.Decode(c, values)
+	c.Id = id
+	if err := checkLength(registry, "text", c.Text); err != nil {
+		return nil, err
+	}
+	if c.Id == nil {
+		if err := checkLength(registry, "other", c.Other); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (a *CompareArg) Documents(registry *registry.Registry) (*Document, *Document, error) {
+	left, err := BuildDocument(0, 0, "", a.Text, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if a.Id != nil {
+		right, err := GetDocument(a.Id, registry)
+		if err != nil {
+			return nil, nil, err
+		}
+		return left, right, checkLength(registry, "document text", right.Text)
+	}
+	right, err := BuildDocument(0, 0, "", a.Other, nil)
+	return left, right, err
+}
+
+func Compare(registry *registry.Registry, arg *CompareArg) (*CompareResult, error) {
+	left, right, err := arg.Documents(registry)
+	if err != nil {
+		return nil, err
+	}
+	association, themes := BuildAssociation(registry.WindowSize, left, right)
+	result := &CompareResult{
+		Success:   true,
+		Fragments: association.Fragments,
+		Themes:    themes.Sort(),
+		Coverage:  association.Coverage,
+	}
+	if arg.Offsets {
+		result.Offsets = association.Fragments.Offsets(left, right)
+	}
+	return result, nil
+}
@@ -0,0 +1,51 @@
+package document
+
+import (
+	"github.com/donovanhide/superfastmatch/registry"
+	. "launchpad.net/gocheck"
+	"net/url"
+	"strings"
+	"unicode/utf16"
+)
+
+type CompareSuite struct{}
+
+var _ = Suite(&CompareSuite{})
+
+func (s *CompareSuite) TestCompare(c *C) {
+	r := &registry.Registry{WindowSize: 30}
+	passage := "The quick brown fox jumps over the lazy dog and keeps on running"
+	text := strings.Repeat("alpha beta ", 10) + passage
+	other := passage + strings.Repeat(" gamma delta", 10)
+	values := url.Values{"text": {text}, "other": {other}}
+	arg, err := NewCompareArg(r, nil, values)
+	c.Assert(err, IsNil)
+	result, err := Compare(r, arg)
+	c.Assert(err, IsNil)
+	c.Assert(len(result.Fragments), Equals, 1)
+	c.Check(len(result.Themes), Equals, 1)
+	c.Check(result.Coverage.Left, Equals, uint64(len(passage)))
+	c.Check(result.Coverage.Right, Equals, uint64(len(passage)))
+	c.Check(result.Coverage.LeftRatio, Equals, float64(len(passage))/float64(len(text)))
+	_, err = NewCompareArg(r, nil, url.Values{"text": {text}, "other": {"short"}})
+	c.Check(err, FitsTypeOf, &LengthError{})
+}
+
+func (s *CompareSuite) TestOffsets(c *C) {
+	doc, _ := BuildDocument(0, 0, "", "aé😀b", nil)
+	offsets := doc.Offsets()
+	c.Check(offsets, DeepEquals, OffsetMap{{0, 0, 0}, {1, 1, 1}, {2, 3, 2}, {3, 7, 4}, {4, 8, 5}})
+	c.Check(offsets.Span(1, 2), Equals, Span{Offset{1, 1, 1}, Offset{3, 7, 4}})
+	c.Check(doc.NormalisedText().RuneCount(), Equals, 4)
+	r := &registry.Registry{WindowSize: 30}
+	passage := "Ünïcödé 😀 text which is repeated in both of the documents being compared"
+	values := url.Values{"text": {"Some preamble. " + passage}, "other": {passage}, "offsets": {"true"}}
+	arg, err := NewCompareArg(r, nil, values)
+	c.Assert(err, IsNil)
+	result, err := Compare(r, arg)
+	c.Assert(err, IsNil)
+	c.Assert(len(result.Offsets), Equals, 1)
+	left := result.Offsets[0].Left
+	c.Check(values.Get("text")[left.Start.Byte:left.End.Byte], Equals, passage)
+	c.Check(left.End.UTF16-left.Start.UTF16, Equals, int32(len(utf16.Encode([]rune(passage)))))
+}
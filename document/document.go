@@ -6,10 +6,10 @@ import (
 	"fmt"
 	"github.com/donovanhide/mux"
 	"github.com/donovanhide/superfastmatch/registry"
+	"labix.org/v2/mgo/bson"
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 	"unicode/utf8"
 )
 
@@ -38,9 +38,12 @@ type Document struct {
 	Valid          bool             `json:"valid"`
 	Meta           MetaMap          `json:"metaData"`
 	Associations   AssociationSlice `json:"associations,omitempty"`
+	Signature      Signature        `json:"-" bson:"signature,omitempty"`
+	Bands          []int64          `json:"-" bson:"bands,omitempty"`
 	hashes         map[HashKey][]uint64
 	blooms         map[BloomKey]Bloom
 	normalisedText *utf8string.String
+	offsets        OffsetMap
 }
 
 func (k *HashKey) String() string {
@@ -140,7 +143,32 @@ func GetDocumentsById(ids []DocumentID, registry *registry.Registry) chan *Docum
 	return c
 }
 
+// Fetches the documents in a single query, in no particular order
+func GetDocumentBatch(ids []DocumentID, registry *registry.Registry) ([]*Document, error) {
+	docs := make([]*Document, 0, len(ids))
+	db := registry.DB()
+	defer db.Session.Close()
+	iter := db.C("documents").Find(bson.M{"_id": bson.M{"$in": ids}}).Iter()
+	for next := new(Document); iter.Next(next); next = new(Document) {
+		docs = append(docs, next.init())
+	}
+	return docs, iter.Close()
+}
+
+// Inserts new documents in a single batch. Fails if any already exists.
+func InsertDocuments(registry *registry.Registry, docs []*Document) error {
+	inserts := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		doc.sign(registry.WindowSize)
+		inserts[i] = doc
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	return db.C("documents").Insert(inserts...)
+}
+
 func (document *Document) Save(registry *registry.Registry) error {
+	document.sign(registry.WindowSize)
 	db := registry.DB()
 	defer db.Session.Close()
 	_, err := db.C("documents").UpsertId(document.Id, document)
@@ -150,24 +178,69 @@ func (document *Document) Save(registry *registry.Registry) error {
 func (document *Document) Delete(registry *registry.Registry) error {
 	db := registry.DB()
 	defer db.Session.Close()
+	if err := removeClusterMembers(db, []DocumentID{document.Id}); err != nil {
+		return err
+	}
 	return db.C("documents").RemoveId(document.Id)
 }
 
-func (d *Document) AddAssociation(registry *registry.Registry, other *Document, saveThemes bool) *Association {
-	association, themes := BuildAssociation(registry.WindowSize, d, other)
+// Removes the documents in a single batch, along with their associations both
+// in their own collection and embedded in other documents, and their cluster
+// memberships. Returns the number of documents removed.
+func DeleteDocuments(registry *registry.Registry, ids []DocumentID) (int, error) {
+	db := registry.DB()
+	defer db.Session.Close()
+	in := bson.M{"$in": ids}
+	associations := bson.M{"$or": []bson.M{{"_id.source": in}, {"_id.target": in}}}
+	if _, err := db.C("associations").RemoveAll(associations); err != nil {
+		return 0, err
+	}
+	pull := bson.M{"$pull": bson.M{"associations": bson.M{"document._id": in}}}
+	if _, err := db.C("documents").UpdateAll(bson.M{"associations.document._id": in}, pull); err != nil {
+		return 0, err
+	}
+	if err := removeClusterMembers(db, ids); err != nil {
+		return 0, err
+	}
+	info, err := db.C("documents").RemoveAll(bson.M{"_id": in})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// Any existing association with other is replaced. If save is true the
+// association and its themes are stored.
+func (d *Document) AddAssociation(registry *registry.Registry, other *Document, save bool) (*Association, error) {
+	return d.addAssociation(registry, registry.WindowSize, other, save)
+}
+
+func (d *Document) addAssociation(registry *registry.Registry, windowSize uint64, other *Document, save bool) (*Association, error) {
+	association, themes := BuildAssociation(windowSize, d, other)
+	association.Text = ""
+	d.Associations = d.Associations.remove(other.Id)
 	if len(association.Fragments) > 0 {
-		association.Text = ""
 		d.Associations = append(d.Associations, *association)
-		if saveThemes {
-			themes.Save(registry)
-		}
 	}
-	return association
+	if !save {
+		return association, nil
+	}
+	if err := association.Save(registry, d.Id); err != nil {
+		return nil, err
+	}
+	if err := themes.Save(registry, d.Id, other.Id); err != nil {
+		return nil, err
+	}
+	return association, nil
 }
 
 func (d *Document) NormalisedText() *utf8string.String {
 	if d.normalisedText == nil {
-		d.normalisedText = utf8string.NewString(strings.Map(normaliseRune, d.Text))
+		runes := make([]rune, 0, d.Length)
+		normalise(d.Text, func(r rune, _ Offset) {
+			runes = append(runes, r)
+		})
+		d.normalisedText = utf8string.NewString(string(runes))
 	}
 	return d.normalisedText
 }
@@ -0,0 +1,284 @@
+package document
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"github.com/donovanhide/superfastmatch/registry"
+	"io"
+	"labix.org/v2/mgo/bson"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Writes the association graph in a format understood by tools such as Gephi.
+// Nodes are only written by formats which declare them.
+type graphWriter interface {
+	ContentType() string
+	Nodes() bool
+	Start(w *bufio.Writer, meta []string)
+	Node(w *bufio.Writer, doc *Document, meta []string)
+	Edges(w *bufio.Writer)
+	Edge(w *bufio.Writer, i int, a *AssociationRecord)
+	End(w *bufio.Writer)
+}
+
+// The number of node documents read at once
+const exportBatchSize = 1000
+
+type graphML struct{}
+type gexf struct{}
+type edgeList struct{}
+
+var graphWriters = map[string]graphWriter{
+	"graphml": graphML{},
+	"gexf":    gexf{},
+	"csv":     edgeList{},
+}
+
+func nodeId(id DocumentID) string {
+	return fmt.Sprintf("%d/%d", id.Doctype, id.Docid)
+}
+
+func escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func metaValue(meta MetaMap, key string) string {
+	return strings.Join(metaStrings(meta[key]), "; ")
+}
+
+func edgeWeights(a *AssociationRecord) [][2]string {
+	return [][2]string{
+		{"fragment_count", strconv.Itoa(a.FragmentCount)},
+		{"characters", strconv.Itoa(a.Coverage.Characters)},
+		{"left_ratio", strconv.FormatFloat(a.Coverage.LeftRatio, 'f', -1, 64)},
+		{"right_ratio", strconv.FormatFloat(a.Coverage.RightRatio, 'f', -1, 64)},
+	}
+}
+
+var edgeAttributes = [][2]string{
+	{"fragment_count", "int"},
+	{"characters", "int"},
+	{"left_ratio", "double"},
+	{"right_ratio", "double"},
+}
+
+func (graphML) ContentType() string { return "application/graphml+xml; charset=utf-8" }
+func (graphML) Nodes() bool         { return true }
+
+func (graphML) Start(w *bufio.Writer, meta []string) {
+	w.WriteString(xml.Header)
+	w.WriteString("<graphml xmlns=\"http://graphml.graphdrawing.org/xmlns\">\n")
+	w.WriteString("<key id=\"title\" for=\"node\" attr.name=\"title\" attr.type=\"string\"/>\n")
+	for i, m := range meta {
+		fmt.Fprintf(w, "<key id=\"meta%d\" for=\"node\" attr.name=\"%s\" attr.type=\"string\"/>\n", i, escape(m))
+	}
+	for _, a := range edgeAttributes {
+		fmt.Fprintf(w, "<key id=\"%s\" for=\"edge\" attr.name=\"%s\" attr.type=\"%s\"/>\n", a[0], a[0], a[1])
+	}
+	w.WriteString("<graph id=\"associations\" edgedefault=\"directed\">\n")
+}
+
+func (graphML) Node(w *bufio.Writer, doc *Document, meta []string) {
+	fmt.Fprintf(w, "<node id=\"%s\"><data key=\"title\">%s</data>", nodeId(doc.Id), escape(doc.Title))
+	for i, m := range meta {
+		if v := metaValue(doc.Meta, m); v != "" {
+			fmt.Fprintf(w, "<data key=\"meta%d\">%s</data>", i, escape(v))
+		}
+	}
+	w.WriteString("</node>\n")
+}
+
+func (graphML) Edges(w *bufio.Writer) {}
+
+func (graphML) Edge(w *bufio.Writer, i int, a *AssociationRecord) {
+	fmt.Fprintf(w, "<edge id=\"e%d\" source=\"%s\" target=\"%s\">", i, nodeId(a.Id.Source), nodeId(a.Id.Target))
+	for _, weight := range edgeWeights(a) {
+		fmt.Fprintf(w, "<data key=\"%s\">%s</data>", weight[0], weight[1])
+	}
+	w.WriteString("</edge>\n")
+}
+
+func (graphML) End(w *bufio.Writer) {
+	w.WriteString("</graph>\n</graphml>\n")
+}
+
+func (gexf) ContentType() string { return "application/gexf+xml; charset=utf-8" }
+func (gexf) Nodes() bool         { return true }
+
+func (gexf) Start(w *bufio.Writer, meta []string) {
+	w.WriteString(xml.Header)
+	w.WriteString("<gexf xmlns=\"http://www.gexf.net/1.2draft\" version=\"1.2\">\n")
+	w.WriteString("<graph mode=\"static\" defaultedgetype=\"directed\">\n")
+	w.WriteString("<attributes class=\"node\">\n")
+	for i, m := range meta {
+		fmt.Fprintf(w, "<attribute id=\"meta%d\" title=\"%s\" type=\"string\"/>\n", i, escape(m))
+	}
+	w.WriteString("</attributes>\n<attributes class=\"edge\">\n")
+	for _, a := range edgeAttributes {
+		fmt.Fprintf(w, "<attribute id=\"%s\" title=\"%s\" type=\"%s\"/>\n", a[0], a[0], a[1])
+	}
+	w.WriteString("</attributes>\n<nodes>\n")
+}
+
+func (gexf) Node(w *bufio.Writer, doc *Document, meta []string) {
+	fmt.Fprintf(w, "<node id=\"%s\" label=\"%s\"><attvalues>", nodeId(doc.Id), escape(doc.Title))
+	for i, m := range meta {
+		if v := metaValue(doc.Meta, m); v != "" {
+			fmt.Fprintf(w, "<attvalue for=\"meta%d\" value=\"%s\"/>", i, escape(v))
+		}
+	}
+	w.WriteString("</attvalues></node>\n")
+}
+
+func (gexf) Edges(w *bufio.Writer) {
+	w.WriteString("</nodes>\n<edges>\n")
+}
+
+func (gexf) Edge(w *bufio.Writer, i int, a *AssociationRecord) {
+	fmt.Fprintf(w, "<edge id=\"%d\" source=\"%s\" target=\"%s\" weight=\"%d\"><attvalues>", i, nodeId(a.Id.Source), nodeId(a.Id.Target), a.Coverage.Characters)
+	for _, weight := range edgeWeights(a) {
+		fmt.Fprintf(w, "<attvalue for=\"%s\" value=\"%s\"/>", weight[0], weight[1])
+	}
+	w.WriteString("</attvalues></edge>\n")
+}
+
+func (gexf) End(w *bufio.Writer) {
+	w.WriteString("</edges>\n</graph>\n</gexf>\n")
+}
+
+func (edgeList) ContentType() string { return "text/csv; charset=utf-8" }
+func (edgeList) Nodes() bool         { return false }
+
+func (edgeList) Start(w *bufio.Writer, meta []string) {
+	w.WriteString("Source,Target,Weight,Title,fragment_count,characters,left_ratio,right_ratio\n")
+}
+
+func (edgeList) Node(w *bufio.Writer, doc *Document, meta []string) {}
+func (edgeList) Edges(w *bufio.Writer)                              {}
+
+func (edgeList) Edge(w *bufio.Writer, i int, a *AssociationRecord) {
+	record := []string{nodeId(a.Id.Source), nodeId(a.Id.Target), strconv.Itoa(a.Coverage.Characters), a.Title}
+	for _, weight := range edgeWeights(a) {
+		record = append(record, weight[1])
+	}
+	c := csv.NewWriter(w)
+	c.Write(record)
+	c.Flush()
+}
+
+func (edgeList) End(w *bufio.Writer) {}
+
+type AssociationExport struct {
+	AssociationQueryParams
+	Format string `schema:"format"`
+	writer graphWriter
+}
+
+func NewAssociationExport(values *url.Values) (*AssociationExport, error) {
+	e := &AssociationExport{Format: "graphml"}
+	decoder.Decode(e, *values)
+	e.Format = strings.ToLower(e.Format)
+	writer, ok := graphWriters[e.Format]
+	if !ok {
+		return nil, fmt.Errorf("Unknown export format: %s", e.Format)
+	}
+	e.writer = writer
+	return e, nil
+}
+
+func (e *AssociationExport) ContentType() string {
+	return e.writer.ContentType()
+}
+
+// Streams the graph to w. Only the ids of the nodes and the names of their
+// meta fields are held in memory, at the cost of reading the associations twice.
+func (e *AssociationExport) Write(out io.Writer, registry *registry.Registry) error {
+	db := registry.DB()
+	defer db.Session.Close()
+	associations := db.C("associations")
+	w := bufio.NewWriter(out)
+	var meta []string
+	nodes := make(map[DocumentID]bool)
+	if e.writer.Nodes() {
+		var a AssociationRecord
+		iter := associations.Find(e.filter()).Select(bson.M{"_id": 1}).Iter()
+		for iter.Next(&a) {
+			nodes[a.Id.Source] = true
+			nodes[a.Id.Target] = true
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		fields := make(map[string]bool)
+		err := e.documents(registry, nodes, func(doc *Document) {
+			for k := range doc.Meta {
+				fields[k] = true
+			}
+		})
+		if err != nil {
+			return err
+		}
+		for k := range fields {
+			meta = append(meta, k)
+		}
+		sort.Strings(meta)
+	}
+	e.writer.Start(w, meta)
+	if e.writer.Nodes() {
+		err := e.documents(registry, nodes, func(doc *Document) {
+			e.writer.Node(w, doc, meta)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	e.writer.Edges(w)
+	var a AssociationRecord
+	iter := associations.Find(e.filter()).Select(bson.M{"fragments": 0}).Sort("_id.source.doctype", "_id.source.docid").Iter()
+	for i := 0; iter.Next(&a); i++ {
+		e.writer.Edge(w, i, &a)
+		a = AssociationRecord{}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	e.writer.End(w)
+	return w.Flush()
+}
+
+// Calls f for each document in nodes, in order of id
+func (e *AssociationExport) documents(registry *registry.Registry, nodes map[DocumentID]bool, f func(*Document)) error {
+	ids := make(DocumentIDSlice, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+	db := registry.DB()
+	defer db.Session.Close()
+	documents := db.C("documents")
+	var doc Document
+	for start := 0; start < len(ids); start += exportBatchSize {
+		end := start + exportBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		query := bson.M{"_id": bson.M{"$in": ids[start:end]}}
+		iter := documents.Find(query).Select(bson.M{"_id": 1, "title": 1, "meta": 1}).Sort("_id").Iter()
+		for iter.Next(&doc) {
+			f(&doc)
+			doc = Document{}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
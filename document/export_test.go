@@ -0,0 +1,88 @@
+package document
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/donovanhide/superfastmatch/testutils"
+	"labix.org/v2/mgo/bson"
+	. "launchpad.net/gocheck"
+	"net/url"
+	"strings"
+)
+
+type ExportSuite struct {
+	testutils.DBSuite
+}
+
+var _ = Suite(&ExportSuite{})
+
+func writeGraph(g graphWriter, doc *Document, a *AssociationRecord) string {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	meta := []string{"source"}
+	g.Start(w, meta)
+	g.Node(w, doc, meta)
+	g.Edges(w)
+	g.Edge(w, 0, a)
+	g.End(w)
+	w.Flush()
+	return buf.String()
+}
+
+func (s *ExportSuite) TestWriters(c *C) {
+	doc := &Document{Id: DocumentID{1, 2}, Title: "Fish & <Chips>", Meta: MetaMap{"source": []string{"bbc", "guardian"}}}
+	a := &AssociationRecord{
+		Id:            AssociationID{Source: DocumentID{1, 2}, Target: DocumentID{3, 4}},
+		Title:         "Other, \"quoted\"",
+		FragmentCount: 2,
+		Coverage:      Coverage{Characters: 120, LeftRatio: 0.5, RightRatio: 0.25},
+	}
+	graphml := writeGraph(graphML{}, doc, a)
+	c.Check(graphml, Matches, `(?s).*<node id="1/2"><data key="title">Fish &amp; &lt;Chips&gt;</data><data key="meta0">bbc; guardian</data></node>.*`)
+	c.Check(graphml, Matches, `(?s).*<edge id="e0" source="1/2" target="3/4"><data key="fragment_count">2</data><data key="characters">120</data>.*`)
+	gexf := writeGraph(gexf{}, doc, a)
+	c.Check(gexf, Matches, `(?s).*</nodes>\n<edges>\n<edge id="0" source="1/2" target="3/4" weight="120">.*`)
+	csv := writeGraph(edgeList{}, doc, a)
+	c.Check(csv, Equals, "Source,Target,Weight,Title,fragment_count,characters,left_ratio,right_ratio\n1/2,3/4,120,\"Other, \"\"quoted\"\"\",2,120,0.5,0.25\n")
+}
+
+func (s *ExportSuite) TestFormat(c *C) {
+	e, err := NewAssociationExport(&url.Values{"format": {"GEXF"}, "source": {"1-2"}})
+	c.Assert(err, IsNil)
+	c.Check(e.ContentType(), Equals, "application/gexf+xml; charset=utf-8")
+	c.Check(e.Source, Equals, DocTypeRange("1-2"))
+	_, err = NewAssociationExport(&url.Values{"format": {"dot"}})
+	c.Check(err, NotNil)
+}
+
+func (s *ExportSuite) TestExport(c *C) {
+	for _, doc := range []struct {
+		id    DocumentID
+		title string
+		meta  MetaMap
+	}{
+		{DocumentID{1, 1}, "Source", MetaMap{"source": "a"}},
+		{DocumentID{2, 1}, "Target", nil},
+		{DocumentID{3, 1}, "Unrelated", MetaMap{"other": "x"}},
+	} {
+		d, _ := BuildDocument(doc.id.Doctype, doc.id.Docid, doc.title, RandomWords(100), doc.meta)
+		c.Assert(d.Save(s.Registry), IsNil)
+	}
+	db := s.Registry.DB()
+	defer db.Session.Close()
+	first := &AssociationRecord{Id: AssociationID{DocumentID{1, 1}, DocumentID{2, 1}}, Title: "Target", FragmentCount: 1}
+	second := bson.M{"_id": AssociationID{DocumentID{1, 1}, DocumentID{2, 2}}, "fragmentcount": 2}
+	c.Assert(db.C("associations").Insert(first, second), IsNil)
+	export := func(format string) string {
+		e, err := NewAssociationExport(&url.Values{"format": {format}})
+		c.Assert(err, IsNil)
+		var buf bytes.Buffer
+		c.Assert(e.Write(&buf, s.Registry), IsNil)
+		return buf.String()
+	}
+	c.Check(export("csv"), Equals, "Source,Target,Weight,Title,fragment_count,characters,left_ratio,right_ratio\n1/1,2/1,0,Target,1,0,0,0\n1/1,2/2,0,,2,0,0,0\n")
+	graph := export("graphml")
+	c.Check(strings.Count(graph, "<node "), Equals, 2)
+	c.Check(strings.Contains(graph, "attr.name=\"source\""), Equals, true)
+	c.Check(strings.Contains(graph, "Unrelated"), Equals, false)
+}
@@ -6,7 +6,8 @@ import (
 	"fmt"
 	"github.com/donovanhide/superfastmatch/registry"
 	"hash/fnv"
-	"reflect"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
 	"sort"
 	"strings"
 	"unicode"
@@ -16,8 +17,17 @@ import (
 type ThemeId uint64
 
 type Theme struct {
-	Id   ThemeId `json:"id" bson:"_id"`
-	Text string  `json:"text"`
+	Id        ThemeId      `json:"id" bson:"_id"`
+	Text      string       `json:"text"`
+	Length    int          `json:"length,omitempty" bson:"length,omitempty"`
+	Count     int          `json:"count,omitempty" bson:"count,omitempty"`
+	Doctypes  []uint32     `json:"doctypes,omitempty" bson:"doctypes,omitempty"`
+	Documents []DocumentID `json:"documents,omitempty" bson:"-"`
+}
+
+type themeDocument struct {
+	Theme    ThemeId    `bson:"theme"`
+	Document DocumentID `bson:"document"`
 }
 
 type ThemeMap map[ThemeId]Theme
@@ -36,6 +46,14 @@ type Fragment struct {
 
 type FragmentSlice []Fragment
 
+type Coverage struct {
+	Characters int     `json:"characters"`
+	Left       uint64  `json:"left"`
+	Right      uint64  `json:"right"`
+	LeftRatio  float64 `json:"left_ratio"`
+	RightRatio float64 `json:"right_ratio"`
+}
+
 func (f FragmentSlice) Len() int      { return len(f) }
 func (f FragmentSlice) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
 func (f FragmentSlice) Less(i, j int) bool {
@@ -58,10 +76,32 @@ func newTheme(text string) *Theme {
 	}
 }
 
-func (m ThemeMap) Save(registry *registry.Registry) error {
+// Records that each theme occurs in the documents identified by ids. Each
+// pairing is stored once in theme_documents rather than in an array on the
+// theme, so the count is the number of distinct documents and a common theme
+// cannot outgrow the maximum document size.
+func (m ThemeMap) Save(registry *registry.Registry, ids ...DocumentID) error {
 	db := registry.DB()
 	defer db.Session.Close()
-	return db.C("theme").Insert(reflect.ValueOf(m).MapKeys())
+	themes, instances := db.C("theme"), db.C("theme_documents")
+	for id, theme := range m {
+		if _, err := themes.UpsertId(id, bson.M{"$set": bson.M{"text": theme.Text, "length": utf8.RuneCountInString(theme.Text)}}); err != nil {
+			return err
+		}
+		for _, docid := range ids {
+			err := instances.Insert(bson.M{"_id": themeDocument{Theme: id, Document: docid}})
+			switch {
+			case mgo.IsDup(err):
+				continue
+			case err != nil:
+				return err
+			}
+			if err := themes.UpdateId(id, bson.M{"$inc": bson.M{"count": 1}, "$addToSet": bson.M{"doctypes": docid.Doctype}}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (m ThemeMap) Sort() ThemeSlice {
@@ -97,6 +137,26 @@ func (s FragmentSlice) String(m ThemeMap) string {
 	return buf.String()
 }
 
+// Characters is the sum of all fragment lengths, Left and Right count each
+// character of the respective document at most once.
+func (s FragmentSlice) Coverage(left, right *Document) Coverage {
+	var c Coverage
+	l, r := make(IntervalSlice, len(s)), make(IntervalSlice, len(s))
+	for i, f := range s {
+		c.Characters += f.Length
+		l[i] = Interval{uint64(f.Left), uint64(f.Left + f.Length - 1)}
+		r[i] = Interval{uint64(f.Right), uint64(f.Right + f.Length - 1)}
+	}
+	c.Left, c.Right = l.Cardinality(), r.Cardinality()
+	if left.Length > 0 {
+		c.LeftRatio = float64(c.Left) / float64(left.Length)
+	}
+	if right.Length > 0 {
+		c.RightRatio = float64(c.Right) / float64(right.Length)
+	}
+	return c
+}
+
 func notWhitespace(r rune) bool {
 	return unicode.IsLetter(r) || unicode.IsDigit(r)
 }
@@ -0,0 +1,255 @@
+package document
+
+import (
+	"errors"
+	"github.com/donovanhide/superfastmatch/registry"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/url"
+	"sync"
+	"unicode/utf8"
+)
+
+// A passage of boilerplate, such as a standard footer, which is ignored
+// when searching and associating documents. An empty range applies to all doctypes.
+type Ignore struct {
+	Id       bson.ObjectId `json:"id" bson:"_id"`
+	Text     string        `json:"text"`
+	Doctypes DocTypeRange  `json:"doctypes"`
+}
+
+type IgnoreResult struct {
+	Success   bool     `json:"success"`
+	TotalRows int      `json:"totalRows"`
+	Rows      []Ignore `json:"rows"`
+}
+
+// The doctypes for which a hash is ignored
+type IgnoreScope struct {
+	global    bool
+	intervals []IntervalSlice
+}
+
+// Ignored hashes for a HashKey
+type IgnoreScopes map[uint64]*IgnoreScope
+
+type ignoreList struct {
+	sync.RWMutex
+	ignores []Ignore
+	hashes  map[HashKey]IgnoreScopes
+	version int
+}
+
+var ignores = newIgnoreList(nil)
+
+func newIgnoreList(list []Ignore) *ignoreList {
+	return &ignoreList{
+		ignores: list,
+		hashes:  make(map[HashKey]IgnoreScopes),
+	}
+}
+
+func (s *IgnoreScope) Contains(doctype uint32) bool {
+	if s == nil {
+		return false
+	}
+	if s.global {
+		return true
+	}
+	for _, intervals := range s.intervals {
+		if intervals.Contains(uint64(doctype)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *IgnoreScope) add(doctypes DocTypeRange) {
+	if len(doctypes) == 0 {
+		s.global = true
+		return
+	}
+	s.intervals = append(s.intervals, doctypes.Intervals())
+}
+
+func (l *ignoreList) scopes(key HashKey) IgnoreScopes {
+	l.RLock()
+	scopes, ok := l.hashes[key]
+	l.RUnlock()
+	if ok {
+		return scopes
+	}
+	l.Lock()
+	defer l.Unlock()
+	if scopes, ok = l.hashes[key]; ok {
+		return scopes
+	}
+	scopes = make(IgnoreScopes)
+	ws := whiteSpaceHash(key)
+	for _, ignore := range l.ignores {
+		doc, _ := BuildDocument(0, 0, "", ignore.Text, nil)
+		for _, h := range doc.Hashes(key) {
+			if h == ws {
+				continue
+			}
+			if scopes[h] == nil {
+				scopes[h] = new(IgnoreScope)
+			}
+			scopes[h].add(ignore.Doctypes)
+		}
+	}
+	l.hashes[key] = scopes
+	return scopes
+}
+
+// Looking up a hash which is not ignored returns a nil scope
+func IgnoredHashes(key HashKey) IgnoreScopes {
+	return ignores.scopes(key)
+}
+
+// Drops fragments which fall inside an ignored passage of the left document,
+// along with any themes which no longer have a fragment. Less than a window of
+// the fragment, such as the punctuation preceding a footer, may lie outside the passage.
+func (l *ignoreList) filter(key HashKey, left, right *Document, fragments FragmentSlice, themes ThemeMap) (FragmentSlice, ThemeMap) {
+	scopes := l.scopes(key)
+	if len(scopes) == 0 {
+		return fragments, themes
+	}
+	hashes, windowSize := left.Hashes(key), int(key.WindowSize)
+	ignored := func(f *Fragment) bool {
+		covered, end := 0, f.Left
+		for i := f.Left; i <= f.Left+f.Length-windowSize && i < len(hashes); i++ {
+			scope := scopes[hashes[i]]
+			if scope.Contains(left.Id.Doctype) || scope.Contains(right.Id.Doctype) {
+				if i > end {
+					end = i
+				}
+				covered += i + windowSize - end
+				end = i + windowSize
+			}
+		}
+		return f.Length-covered < windowSize
+	}
+	kept, used := make(FragmentSlice, 0, len(fragments)), make(map[ThemeId]bool)
+	for i := range fragments {
+		if !ignored(&fragments[i]) {
+			kept = append(kept, fragments[i])
+			used[fragments[i].Id] = true
+		}
+	}
+	for id := range themes {
+		if !used[id] {
+			delete(themes, id)
+		}
+	}
+	return kept, themes
+}
+
+// Replaces the in-memory list with the stored passages
+func LoadIgnores(registry *registry.Registry) error {
+	db := registry.DB()
+	defer db.Session.Close()
+	return loadIgnores(db)
+}
+
+// Reloads the stored passages if another process has changed them since the last load
+func RefreshIgnores(registry *registry.Registry) error {
+	db := registry.DB()
+	defer db.Session.Close()
+	version, err := ignoresVersion(db)
+	if err != nil {
+		return err
+	}
+	ignores.RLock()
+	current := ignores.version
+	ignores.RUnlock()
+	if version == current {
+		return nil
+	}
+	return loadIgnores(db)
+}
+
+// The version is read first so that a change made during the load is picked up by the next refresh
+func loadIgnores(db *mgo.Database) error {
+	version, err := ignoresVersion(db)
+	if err != nil {
+		return err
+	}
+	list := make([]Ignore, 0)
+	if err := db.C("ignores").Find(nil).All(&list); err != nil {
+		return err
+	}
+	ignores.Lock()
+	defer ignores.Unlock()
+	ignores.ignores, ignores.hashes, ignores.version = list, make(map[HashKey]IgnoreScopes), version
+	return nil
+}
+
+func ignoresVersion(db *mgo.Database) (int, error) {
+	var state struct {
+		Version int
+	}
+	switch err := db.C("settings").FindId("ignores").One(&state); {
+	case err == mgo.ErrNotFound:
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+	return state.Version, nil
+}
+
+// Every change to the stored passages bumps the version, which processes compare on refresh
+func touchIgnores(db *mgo.Database) error {
+	_, err := db.C("settings").UpsertId("ignores", bson.M{"$inc": bson.M{"version": 1}})
+	return err
+}
+
+func GetIgnores(values *url.Values, registry *registry.Registry) (*IgnoreResult, error) {
+	r := &IgnoreResult{Success: true, Rows: make([]Ignore, 0)}
+	query := bson.M{}
+	if doctypes := values.Get("doctypes"); doctypes != "" {
+		query["doctypes"] = doctypes
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	if err := db.C("ignores").Find(query).All(&r.Rows); err != nil {
+		return nil, err
+	}
+	r.TotalRows = len(r.Rows)
+	return r, nil
+}
+
+func NewIgnore(registry *registry.Registry, values *url.Values) (*Ignore, error) {
+	ignore := &Ignore{
+		Id:       bson.NewObjectId(),
+		Text:     values.Get("text"),
+		Doctypes: DocTypeRange(values.Get("doctypes")),
+	}
+	if uint64(utf8.RuneCountInString(ignore.Text)) < registry.WindowSize {
+		return nil, errors.New("Ignored text shorter than window size")
+	}
+	if len(ignore.Doctypes) > 0 && !ignore.Doctypes.Valid() {
+		return nil, errors.New("Bad doctypes")
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	if err := db.C("ignores").Insert(ignore); err != nil {
+		return nil, err
+	}
+	if err := touchIgnores(db); err != nil {
+		return nil, err
+	}
+	return ignore, nil
+}
+
+func DeleteIgnore(registry *registry.Registry, id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return errors.New("Bad ignore id")
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	if err := db.C("ignores").RemoveId(bson.ObjectIdHex(id)); err != nil {
+		return err
+	}
+	return touchIgnores(db)
+}
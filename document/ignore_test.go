@@ -0,0 +1,50 @@
+package document
+
+import (
+	. "launchpad.net/gocheck"
+	"strings"
+)
+
+type IgnoreSuite struct{}
+
+var _ = Suite(&IgnoreSuite{})
+
+const ignoreFooter = "All rights reserved. Reproduction of this article without the written permission of the publisher is prohibited."
+
+func ignoreDocuments() (*Document, *Document) {
+	shared := "Ministers have agreed a settlement with the unions after nine weeks of tense negotiations over pay and pensions."
+	left, _ := BuildDocument(1, 1, "Left", strings.Join([]string{"Morning edition.", shared, "Weather follows.", ignoreFooter}, " "), nil)
+	right, _ := BuildDocument(2, 1, "Right", strings.Join([]string{"Evening news.", shared, "Sport follows.", ignoreFooter}, " "), nil)
+	return left, right
+}
+
+func (s *IgnoreSuite) TestFilter(c *C) {
+	defer func() { ignores = newIgnoreList(nil) }()
+	left, right := ignoreDocuments()
+	association, _ := BuildAssociation(30, left, right)
+	c.Assert(association.Fragments, HasLen, 2)
+	ignores = newIgnoreList([]Ignore{{Text: ignoreFooter, Doctypes: "3"}})
+	left, right = ignoreDocuments()
+	association, _ = BuildAssociation(30, left, right)
+	c.Check(association.Fragments, HasLen, 2)
+	ignores = newIgnoreList([]Ignore{{Text: ignoreFooter, Doctypes: "2"}})
+	left, right = ignoreDocuments()
+	association, themes := BuildAssociation(30, left, right)
+	c.Assert(association.Fragments, HasLen, 1)
+	c.Check(themes, HasLen, 1)
+	c.Check(left.NormalisedText().Slice(association.Fragments[0].Left, association.Fragments[0].Left+10), Equals, "MINISTERS ")
+}
+
+func (s *IgnoreSuite) TestScope(c *C) {
+	scope := new(IgnoreScope)
+	c.Check((*IgnoreScope)(nil).Contains(1), Equals, false)
+	scope.add("2-4:7")
+	c.Check(scope.Contains(3), Equals, true)
+	c.Check(scope.Contains(5), Equals, false)
+	scope.add("")
+	c.Check(scope.Contains(5), Equals, true)
+	list := newIgnoreList([]Ignore{{Text: ignoreFooter}})
+	key := HashKey{WindowSize: 27, HashWidth: 32}
+	doc, _ := BuildDocument(1, 1, "", ignoreFooter, nil)
+	c.Check(list.scopes(key)[doc.Hashes(key)[0]].Contains(9), Equals, true)
+}
@@ -0,0 +1,107 @@
+package document
+
+import (
+	"fmt"
+	"labix.org/v2/mgo/bson"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const metaPrefix = "meta."
+
+type MetaFilter struct {
+	Field    string
+	Operator string
+	Value    string
+}
+
+type MetaFilters []MetaFilter
+
+var metaOperators = map[string]string{
+	"=":  "",
+	"!=": "$ne",
+	">":  "$gt",
+	">=": "$gte",
+	"<":  "$lt",
+	"<=": "$lte",
+}
+
+// Parses values such as meta.source=guardian&meta.published>=2013-01-01.
+// As url.ParseQuery splits on the first '=', the operator is either the
+// trailing character of the key or, for strict inequalities, embedded in a
+// key with an empty value. An operator without a value is a bad filter.
+func ParseMetaFilters(values url.Values) (MetaFilters, error) {
+	keys := make([]string, 0)
+	for k := range values {
+		if strings.HasPrefix(k, metaPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	filters := make(MetaFilters, 0)
+	for _, k := range keys {
+		for _, v := range values[k] {
+			f, err := parseMetaFilter(strings.TrimPrefix(k, metaPrefix), v)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, *f)
+		}
+	}
+	return filters, nil
+}
+
+func parseMetaFilter(key, value string) (*MetaFilter, error) {
+	f := &MetaFilter{Field: key, Operator: "=", Value: value}
+	switch i := strings.IndexAny(key, "!<>"); {
+	case i == -1:
+	case i == len(key)-1 && value != "":
+		f.Field, f.Operator = key[:i], key[i:]+"="
+	case i < len(key)-1 && key[i] != '!' && value == "":
+		f.Field, f.Operator, f.Value = key[:i], key[i:i+1], key[i+1:]
+	default:
+		return nil, fmt.Errorf("Bad meta filter: %s%s", metaPrefix, key)
+	}
+	if f.Field == "" || strings.ContainsAny(f.Field, "!<>=$") {
+		return nil, fmt.Errorf("Bad meta filter: %s%s", metaPrefix, key)
+	}
+	return f, nil
+}
+
+func (f *MetaFilter) Condition() bson.M {
+	if op := metaOperators[f.Operator]; op != "" {
+		return bson.M{metaPrefix + f.Field: bson.M{op: f.Value}}
+	}
+	return bson.M{metaPrefix + f.Field: f.Value}
+}
+
+// Combines the filters with another query, leaving it untouched if there are no filters
+func (s MetaFilters) Query(query bson.M) bson.M {
+	if len(s) == 0 {
+		return query
+	}
+	conditions := []bson.M{query}
+	for i := range s {
+		conditions = append(conditions, s[i].Condition())
+	}
+	return bson.M{"$and": conditions}
+}
+
+func metaStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		s := make([]string, len(v))
+		for i := range v {
+			s[i] = fmt.Sprint(v[i])
+		}
+		return s
+	}
+	return []string{fmt.Sprint(value)}
+}
@@ -0,0 +1,51 @@
+package document
+
+import (
+	"labix.org/v2/mgo/bson"
+	. "launchpad.net/gocheck"
+	"net/url"
+)
+
+type MetaSuite struct{}
+
+var _ = Suite(&MetaSuite{})
+
+func (s *MetaSuite) TestParseMetaFilters(c *C) {
+	values, _ := url.ParseQuery("meta.source=guardian&meta.published>=2013-01-01&meta.published<2014&meta.author!=bob&doctypes=1-2")
+	filters, err := ParseMetaFilters(values)
+	c.Assert(err, IsNil)
+	c.Check(filters, DeepEquals, MetaFilters{
+		{"author", "!=", "bob"},
+		{"published", "<", "2014"},
+		{"published", ">=", "2013-01-01"},
+		{"source", "=", "guardian"},
+	})
+	c.Check(filters[1].Condition(), DeepEquals, bson.M{"meta.published": bson.M{"$lt": "2014"}})
+	c.Check(filters[3].Condition(), DeepEquals, bson.M{"meta.source": "guardian"})
+	_, err = ParseMetaFilters(url.Values{"meta.": {"x"}})
+	c.Check(err, NotNil)
+	_, err = ParseMetaFilters(url.Values{"meta.$where": {"x"}})
+	c.Check(err, NotNil)
+	for _, query := range []string{"meta.x>=", "meta.x<", "meta.x!=", "meta.x<=&meta.y=1"} {
+		values, _ = url.ParseQuery(query)
+		_, err = ParseMetaFilters(values)
+		c.Check(err, NotNil, Commentf(query))
+	}
+	values, _ = url.ParseQuery("meta.x=")
+	filters, err = ParseMetaFilters(values)
+	c.Check(err, IsNil)
+	c.Check(filters, DeepEquals, MetaFilters{{"x", "=", ""}})
+}
+
+func (s *MetaSuite) TestQuery(c *C) {
+	values, _ := url.ParseQuery("meta.source=guardian&meta.published>=2013-01-01&meta.author!=bob")
+	filters, _ := ParseMetaFilters(values)
+	ids := bson.M{"_id": bson.M{"$in": []DocumentID{{1, 1}, {1, 2}}}}
+	c.Check(filters.Query(ids), DeepEquals, bson.M{"$and": []bson.M{
+		ids,
+		{"meta.author": bson.M{"$ne": "bob"}},
+		{"meta.published": bson.M{"$gte": "2013-01-01"}},
+		{"meta.source": "guardian"},
+	}})
+	c.Check(MetaFilters{}.Query(ids), DeepEquals, ids)
+}
@@ -0,0 +1,57 @@
+package document
+
+// Position of a rune of the original text in various units
+type Offset struct {
+	Rune  int32 `json:"rune"`
+	Byte  int32 `json:"byte"`
+	UTF16 int32 `json:"utf16"`
+}
+
+type Span struct {
+	Start Offset `json:"start"`
+	End   Offset `json:"end"`
+}
+
+type FragmentOffsets struct {
+	Left  Span `json:"left"`
+	Right Span `json:"right"`
+}
+
+// Indexed by rune position in the normalised text, with a trailing entry for
+// the end of the original text.
+type OffsetMap []Offset
+
+func newOffsetMap(text string, length uint64) OffsetMap {
+	m := make(OffsetMap, 0, length+1)
+	end := normalise(text, func(_ rune, o Offset) {
+		m = append(m, o)
+	})
+	return append(m, end)
+}
+
+// Spans the original text from which the normalised runes [start,start+length) were derived
+func (m OffsetMap) Span(start, length int) Span {
+	return Span{
+		Start: m[start],
+		End:   m[start+length],
+	}
+}
+
+func (d *Document) Offsets() OffsetMap {
+	if d.offsets == nil {
+		d.offsets = newOffsetMap(d.Text, d.Length)
+	}
+	return d.offsets
+}
+
+func (s FragmentSlice) Offsets(left, right *Document) []FragmentOffsets {
+	l, r := left.Offsets(), right.Offsets()
+	offsets := make([]FragmentOffsets, len(s))
+	for i, f := range s {
+		offsets[i] = FragmentOffsets{
+			Left:  l.Span(f.Left, f.Length),
+			Right: r.Span(f.Right, f.Length),
+		}
+	}
+	return offsets
+}
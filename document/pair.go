@@ -49,6 +49,25 @@ func (p *Pairs) Append(left int32, right PositionSlice) {
 	p.right = append(p.right, right...)
 }
 
+// Keeps only the pairs where the right position follows the left. Used when
+// comparing a document with itself to drop each position's match with itself
+// and the mirror image of every other match.
+func (p *Pairs) UpperTriangle() *Pairs {
+	upper, buf := NewPairs(len(p.steps)), make(PositionSlice, 0)
+	for _, s := range p.steps {
+		for _, r := range p.right[s.start : s.start+s.length] {
+			if r > s.left {
+				buf = append(buf, r)
+			}
+		}
+		if len(buf) > 0 {
+			upper.Append(s.left, buf)
+			buf = buf[:0]
+		}
+	}
+	return upper
+}
+
 func (p *Pairs) Sort() {
 	p.steps.ShellSort()
 	// sort.Sort(p.steps)
@@ -0,0 +1,150 @@
+package document
+
+import (
+	"github.com/donovanhide/superfastmatch/registry"
+	"labix.org/v2/mgo/bson"
+	"net/url"
+	"sort"
+)
+
+type Source struct {
+	Id    DocumentID `json:"id"`
+	Title string     `json:"title"`
+	Date  string     `json:"date,omitempty"`
+}
+
+type SourceSlice []Source
+
+// A passage of the document along with every known document containing it,
+// the earliest first.
+type Passage struct {
+	Theme    ThemeId     `json:"theme"`
+	Text     string      `json:"text"`
+	Length   int         `json:"length"`
+	Earliest Source      `json:"earliest"`
+	Reuse    SourceSlice `json:"reuse"`
+}
+
+type PassageSlice []Passage
+
+type ProvenanceResult struct {
+	Success   bool         `json:"success"`
+	Id        DocumentID   `json:"id"`
+	DateField string       `json:"date_field"`
+	Original  int          `json:"original"`
+	Passages  PassageSlice `json:"passages"`
+}
+
+// Documents without a date are ordered after those with one
+func (s SourceSlice) Len() int      { return len(s) }
+func (s SourceSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s SourceSlice) Less(i, j int) bool {
+	switch {
+	case s[i].Date == s[j].Date:
+		return DocumentIDSlice{s[i].Id, s[j].Id}.Less(0, 1)
+	case s[i].Date == "":
+		return false
+	case s[j].Date == "":
+		return true
+	}
+	return s[i].Date < s[j].Date
+}
+
+func (p PassageSlice) Len() int      { return len(p) }
+func (p PassageSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p PassageSlice) Less(i, j int) bool {
+	return p[i].Length > p[j].Length || (p[i].Length == p[j].Length && p[i].Theme < p[j].Theme)
+}
+
+func newSource(doc *Document, dateField string) Source {
+	source := Source{Id: doc.Id, Title: doc.Title}
+	if dates := metaStrings(doc.Meta[dateField]); len(dates) > 0 {
+		source.Date = dates[0]
+	}
+	return source
+}
+
+// Orders the documents sharing each passage by date
+func buildPassages(themes []Theme, sources map[DocumentID]Source) PassageSlice {
+	passages := make(PassageSlice, 0, len(themes))
+	for _, theme := range themes {
+		chain := make(SourceSlice, 0, len(theme.Documents))
+		for _, id := range theme.Documents {
+			if source, ok := sources[id]; ok {
+				chain = append(chain, source)
+			}
+		}
+		if len(chain) == 0 {
+			continue
+		}
+		sort.Sort(chain)
+		passages = append(passages, Passage{
+			Theme:    theme.Id,
+			Text:     theme.Text,
+			Length:   theme.Length,
+			Earliest: chain[0],
+			Reuse:    chain[1:],
+		})
+	}
+	sort.Sort(passages)
+	return passages
+}
+
+// Walks the themes of the document's associations across every document containing them
+func GetProvenance(id *DocumentID, values *url.Values, registry *registry.Registry) (*ProvenanceResult, error) {
+	doc, err := GetDocument(id, registry)
+	if err != nil {
+		return nil, err
+	}
+	r := &ProvenanceResult{
+		Success:   true,
+		Id:        doc.Id,
+		DateField: values.Get("date_field"),
+		Passages:  make(PassageSlice, 0),
+	}
+	if r.DateField == "" {
+		r.DateField = registry.DateField
+	}
+	ids := make([]ThemeId, 0)
+	seen := make(map[ThemeId]bool)
+	for _, a := range doc.Associations {
+		for _, f := range a.Fragments {
+			if !seen[f.Id] {
+				seen[f.Id] = true
+				ids = append(ids, f.Id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return r, nil
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	var themes []Theme
+	if err := db.C("theme").Find(bson.M{"_id": bson.M{"$in": ids}}).All(&themes); err != nil {
+		return nil, err
+	}
+	if err := fillThemeDocuments(db, themes); err != nil {
+		return nil, err
+	}
+	docids := []DocumentID{doc.Id}
+	for _, theme := range themes {
+		docids = append(docids, theme.Documents...)
+	}
+	sources := map[DocumentID]Source{doc.Id: newSource(doc, r.DateField)}
+	fields := bson.M{"_id": 1, "title": 1, "meta." + r.DateField: 1}
+	iter := db.C("documents").Find(bson.M{"_id": bson.M{"$in": docids}}).Select(fields).Iter()
+	for next := new(Document); iter.Next(next); next = new(Document) {
+		sources[next.Id] = newSource(next, r.DateField)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	r.Passages = buildPassages(themes, sources)
+	for _, p := range r.Passages {
+		if p.Earliest.Id == doc.Id {
+			r.Original++
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,36 @@
+package document
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type ProvenanceSuite struct{}
+
+var _ = Suite(&ProvenanceSuite{})
+
+func (s *ProvenanceSuite) TestNewSource(c *C) {
+	doc := &Document{Id: DocumentID{1, 1}, Title: "First", Meta: MetaMap{"published": []interface{}{"2001-02-03", "2004-05-06"}}}
+	c.Check(newSource(doc, "published"), DeepEquals, Source{Id: DocumentID{1, 1}, Title: "First", Date: "2001-02-03"})
+	c.Check(newSource(doc, "updated").Date, Equals, "")
+}
+
+func (s *ProvenanceSuite) TestBuildPassages(c *C) {
+	sources := map[DocumentID]Source{
+		{1, 1}: {Id: DocumentID{1, 1}, Date: "2010-01-01"},
+		{1, 2}: {Id: DocumentID{1, 2}, Date: "2009-06-01"},
+		{2, 1}: {Id: DocumentID{2, 1}},
+		{2, 2}: {Id: DocumentID{2, 2}, Date: "2011-03-04"},
+	}
+	themes := []Theme{
+		{Id: 1, Text: "short", Length: 5, Documents: []DocumentID{{1, 1}, {2, 1}}},
+		{Id: 2, Text: "a longer passage", Length: 16, Documents: []DocumentID{{2, 2}, {2, 1}, {1, 1}, {1, 2}}},
+		{Id: 3, Text: "deleted", Length: 7, Documents: []DocumentID{{3, 1}}},
+	}
+	passages := buildPassages(themes, sources)
+	c.Assert(passages, HasLen, 2)
+	c.Check(passages[0].Theme, Equals, ThemeId(2))
+	c.Check(passages[0].Earliest.Id, Equals, DocumentID{1, 2})
+	c.Check(passages[0].Reuse, DeepEquals, SourceSlice{sources[DocumentID{1, 1}], sources[DocumentID{2, 2}], sources[DocumentID{2, 1}]})
+	c.Check(passages[1].Earliest.Id, Equals, DocumentID{1, 1})
+	c.Check(passages[1].Reuse, HasLen, 1)
+}
@@ -21,6 +21,7 @@ type QueryParams struct {
 type DocumentQueryParams struct {
 	QueryParams
 	Doctypes DocTypeRange `schema:"doctypes"`
+	Meta     MetaFilters  `schema:"-"`
 }
 
 type DocumentResult struct {
@@ -28,6 +29,12 @@ type DocumentResult struct {
 	TotalRows int        `json:"totalRows"`
 }
 
+type DocumentCountResult struct {
+	Success  bool         `json:"success"`
+	Doctypes DocTypeRange `json:"doctypes"`
+	Count    int          `json:"count"`
+}
+
 var decoder = schema.NewDecoder()
 
 func init() {
@@ -58,9 +65,11 @@ func GetDocuments(values *url.Values, registry *registry.Registry) (*DocumentRes
 	q := new(DocumentQueryParams)
 	r := new(DocumentResult)
 	decoder.Decode(q, *values)
-	if len(q.Doctypes) > 0 {
-		q.Filter = q.Doctypes.Parse()
+	var err error
+	if q.Meta, err = ParseMetaFilters(*values); err != nil {
+		return nil, err
 	}
+	q.Filter = q.Meta.Query(q.Doctypes.Parse())
 	q.Select = bson.M{"text": 0}
 	q.DefaultSort = []string{"_id.doctype", "_id.docid"}
 	db := registry.DB()
@@ -88,3 +97,13 @@ func GetDocids(docTypeRange string, registry *registry.Registry) ([]DocumentID,
 	err := iter.Close()
 	return ids, err
 }
+
+func CountDocuments(docTypeRange string, registry *registry.Registry) (*DocumentCountResult, error) {
+	db := registry.DB()
+	defer db.Session.Close()
+	count, err := db.C("documents").Find(DocTypeRange(docTypeRange).Parse()).Count()
+	if err != nil {
+		return nil, err
+	}
+	return &DocumentCountResult{Success: true, Doctypes: DocTypeRange(docTypeRange), Count: count}, nil
+}
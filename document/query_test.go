@@ -35,6 +35,11 @@ var doctypeRangeTests = []struct {
 	{":1-2", false, IntervalSlice{}},
 	{"asas1-2asas", false, IntervalSlice{}},
 	{"1:2asas", false, IntervalSlice{}},
+	{"5/1000-2000:7/42", true, IntervalSlice{{5, 5}, {7, 7}}},
+	{"1-2/3,5-9:4", true, IntervalSlice{{1, 2}, {4, 4}}},
+	{"5/", false, IntervalSlice{}},
+	{"5/1,", false, IntervalSlice{}},
+	{"5/1/2", false, IntervalSlice{}},
 }
 
 func buildValues(method string, url string, doctypes string) *url.Values {
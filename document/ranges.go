@@ -30,48 +30,128 @@ func (s IntervalSlice) Contains(value uint64) bool {
 	return false
 }
 
-var docTypeRangeRegex = regexp.MustCompile(`^(\d+(-\d+)?(:\d+(-\d+)?)*)*$`)
+// Returns the number of distinct values covered by the intervals
+func (s IntervalSlice) Cardinality() uint64 {
+	sort.Sort(s)
+	total, end := uint64(0), uint64(0)
+	for i, interval := range s {
+		switch {
+		case i == 0 || interval.start > end:
+			total += interval.end - interval.start + 1
+			end = interval.end
+		case interval.end > end:
+			total += interval.end - end
+			end = interval.end
+		}
+	}
+	return total
+}
+
+// A section selects a doctype or range of doctypes, optionally followed by a
+// comma separated list of docids or docid ranges, eg. 5/1000-2000,3000:7/42
+const rangeSection = `\d+(-\d+)?(/\d+(-\d+)?(,\d+(-\d+)?)*)?`
+
+var docTypeRangeRegex = regexp.MustCompile(`^(` + rangeSection + `(:` + rangeSection + `)*)?$`)
+
+// The docids of a selection are empty when every docid is selected
+type Selection struct {
+	Doctypes Interval
+	Docids   IntervalSlice
+}
+
+type Selector []Selection
 
 func (r DocTypeRange) Valid() bool {
 	return docTypeRangeRegex.MatchString(string(r))
 }
 
-func (r DocTypeRange) Intervals() IntervalSlice {
+func parseInterval(s string) Interval {
+	g := strings.Split(s, "-")
+	start, _ := strconv.ParseUint(g[0], 10, 32)
+	if len(g) == 2 {
+		end, _ := strconv.ParseUint(g[1], 10, 32)
+		if start > end {
+			return Interval{end, start}
+		}
+		return Interval{start, end}
+	}
+	return Interval{start, start}
+}
+
+func (r DocTypeRange) Selector() Selector {
 	if len(r) == 0 || !r.Valid() {
-		return IntervalSlice{}
+		return Selector{}
 	}
 	sections := strings.Split(string(r), ":")
-	intervals := make(IntervalSlice, len(sections))
+	selector := make(Selector, len(sections))
 	for i, f := range sections {
-		g := strings.Split(f, "-")
-		start, _ := strconv.ParseUint(g[0], 10, 32)
+		g := strings.SplitN(f, "/", 2)
+		selector[i].Doctypes = parseInterval(g[0])
 		if len(g) == 2 {
-			end, _ := strconv.ParseUint(g[1], 10, 32)
-			if start > end {
-				intervals[i] = Interval{end, start}
-			} else {
-				intervals[i] = Interval{start, end}
+			docids := strings.Split(g[1], ",")
+			selector[i].Docids = make(IntervalSlice, len(docids))
+			for j, docid := range docids {
+				selector[i].Docids[j] = parseInterval(docid)
 			}
+			sort.Sort(selector[i].Docids)
+		}
+	}
+	return selector
+}
 
-		} else {
-			intervals[i] = Interval{start, start}
+func (s Selector) Contains(id DocumentID) bool {
+	for _, selection := range s {
+		if id.Doctype < uint32(selection.Doctypes.start) || id.Doctype > uint32(selection.Doctypes.end) {
+			continue
+		}
+		if len(selection.Docids) == 0 {
+			return true
+		}
+		for _, docids := range selection.Docids {
+			if uint64(id.Docid) >= docids.start && uint64(id.Docid) <= docids.end {
+				return true
+			}
 		}
 	}
+	return false
+}
+
+// Returns the doctypes of every section, ignoring any docid restrictions
+func (r DocTypeRange) Intervals() IntervalSlice {
+	selector := r.Selector()
+	intervals := make(IntervalSlice, len(selector))
+	for i := range selector {
+		intervals[i] = selector[i].Doctypes
+	}
 	sort.Sort(intervals)
 	return intervals
 }
 
+func (i Interval) condition() interface{} {
+	if i.start != i.end {
+		return bson.M{"$gte": i.start, "$lte": i.end}
+	}
+	return i.start
+}
+
 func (r DocTypeRange) Parse() bson.M {
+	return r.ParseField("_id.doctype")
+}
+
+// Builds a query matching the range against the doctype stored in field. Any
+// docids are matched against the sibling docid field.
+func (r DocTypeRange) ParseField(field string) bson.M {
 	if len(r) == 0 {
 		return bson.M{}
 	}
-	intervals := r.Intervals()
-	filter := make([]bson.M, len(intervals))
-	for i, interval := range intervals {
-		if interval.start != interval.end {
-			filter[i] = bson.M{"_id.doctype": bson.M{"$gte": interval.start, "$lte": interval.end}}
-		} else {
-			filter[i] = bson.M{"_id.doctype": interval.start}
+	docidField := strings.TrimSuffix(field, "doctype") + "docid"
+	filter := make([]bson.M, 0)
+	for _, selection := range r.Selector() {
+		if len(selection.Docids) == 0 {
+			filter = append(filter, bson.M{field: selection.Doctypes.condition()})
+		}
+		for _, docids := range selection.Docids {
+			filter = append(filter, bson.M{field: selection.Doctypes.condition(), docidField: docids.condition()})
 		}
 	}
 	return bson.M{"$or": filter}
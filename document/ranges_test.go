@@ -0,0 +1,33 @@
+package document
+
+import (
+	"labix.org/v2/mgo/bson"
+	. "launchpad.net/gocheck"
+)
+
+type RangesSuite struct{}
+
+var _ = Suite(&RangesSuite{})
+
+func (s *RangesSuite) TestCardinality(c *C) {
+	c.Check(IntervalSlice{}.Cardinality(), Equals, uint64(0))
+	c.Check(IntervalSlice{{1, 1}}.Cardinality(), Equals, uint64(1))
+	c.Check(IntervalSlice{{5, 9}, {1, 3}}.Cardinality(), Equals, uint64(8))
+	c.Check(IntervalSlice{{1, 5}, {3, 7}, {4, 6}}.Cardinality(), Equals, uint64(7))
+	c.Check(IntervalSlice{{1, 5}, {6, 7}}.Cardinality(), Equals, uint64(7))
+}
+
+func (s *RangesSuite) TestSelector(c *C) {
+	selector := DocTypeRange("5/1000-2000,3000:7/42:9").Selector()
+	c.Check(selector.Contains(DocumentID{5, 1500}), Equals, true)
+	c.Check(selector.Contains(DocumentID{5, 3000}), Equals, true)
+	c.Check(selector.Contains(DocumentID{5, 2500}), Equals, false)
+	c.Check(selector.Contains(DocumentID{7, 42}), Equals, true)
+	c.Check(selector.Contains(DocumentID{7, 43}), Equals, false)
+	c.Check(selector.Contains(DocumentID{9, 1}), Equals, true)
+	c.Check(selector.Contains(DocumentID{8, 1}), Equals, false)
+	c.Check(DocTypeRange("5/1000-2000:7").ParseField("_id.target.doctype"), DeepEquals, bson.M{"$or": []bson.M{
+		{"_id.target.doctype": uint64(5), "_id.target.docid": bson.M{"$gte": uint64(1000), "$lte": uint64(2000)}},
+		{"_id.target.doctype": uint64(7)},
+	}})
+}
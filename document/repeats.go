@@ -0,0 +1,67 @@
+package document
+
+import (
+	"github.com/donovanhide/superfastmatch/registry"
+	"labix.org/v2/mgo"
+)
+
+// Passages which occur more than once within a single document. Each fragment's
+// Left is the earlier occurrence and Right the later one. The right coverage is
+// the proportion of the document which duplicates earlier text.
+type Repeats struct {
+	Id        DocumentID    `json:"id" bson:"_id"`
+	Title     string        `json:"title"`
+	Fragments FragmentSlice `json:"fragments"`
+	Themes    ThemeSlice    `json:"themes"`
+	Coverage  Coverage      `json:"coverage"`
+}
+
+type RepeatsResult struct {
+	Repeats
+	Success bool `json:"success"`
+}
+
+func BuildRepeats(windowSize uint64, doc *Document) *Repeats {
+	repeats := &Repeats{
+		Id:        doc.Id,
+		Title:     doc.Title,
+		Fragments: make(FragmentSlice, 0),
+		Themes:    make(ThemeSlice, 0),
+	}
+	hashKey := associationHashKey(windowSize)
+	if doc.HashLength(hashKey) == 0 {
+		return repeats
+	}
+	pairs := Common(doc, doc, hashKey).UpperTriangle()
+	fragments, themes := pairs.BuildFragments(doc, int(hashKey.WindowSize), int(windowSize))
+	fragments, themes = ignores.filter(hashKey, doc, doc, fragments, themes)
+	repeats.Fragments, repeats.Themes = fragments, themes.Sort()
+	repeats.Coverage = fragments.Coverage(doc, doc)
+	return repeats
+}
+
+func GetRepeats(id *DocumentID, registry *registry.Registry) (*RepeatsResult, error) {
+	doc, err := GetDocument(id, registry)
+	if err != nil {
+		return nil, err
+	}
+	return &RepeatsResult{
+		Repeats: *BuildRepeats(registry.WindowSize, doc),
+		Success: true,
+	}, nil
+}
+
+// Stores the repeats, removing any stale record if there are none
+func (r *Repeats) Save(registry *registry.Registry) error {
+	db := registry.DB()
+	defer db.Session.Close()
+	repeats := db.C("repeats")
+	if len(r.Fragments) == 0 {
+		if err := repeats.RemoveId(r.Id); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	_, err := repeats.UpsertId(r.Id, r)
+	return err
+}
@@ -0,0 +1,28 @@
+package document
+
+import (
+	. "launchpad.net/gocheck"
+	"strings"
+)
+
+type RepeatsSuite struct{}
+
+var _ = Suite(&RepeatsSuite{})
+
+func (s *RepeatsSuite) TestBuildRepeats(c *C) {
+	story := "The quick brown fox jumps over the lazy dog and keeps on running"
+	text := "Wire copy: " + story + " and then something completely different happens in between the two copies of the story" + " " + story
+	doc, _ := BuildDocument(1, 1, "Repeated", text, nil)
+	repeats := BuildRepeats(30, doc)
+	c.Assert(len(repeats.Fragments), Equals, 1)
+	f := repeats.Fragments[0]
+	c.Check(f.Left, Equals, strings.Index(text, story))
+	c.Check(f.Right, Equals, strings.LastIndex(text, story))
+	c.Check(f.Length, Equals, len(story))
+	c.Check(len(repeats.Themes), Equals, 1)
+	c.Check(repeats.Coverage.Right, Equals, uint64(len(story)))
+	unique, _ := BuildDocument(1, 2, "Unique", story+" but nothing in this sentence is ever said twice", nil)
+	c.Check(len(BuildRepeats(30, unique).Fragments), Equals, 0)
+	short, _ := BuildDocument(1, 3, "Short", "Too short", nil)
+	c.Check(len(BuildRepeats(30, short).Fragments), Equals, 0)
+}
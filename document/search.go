@@ -5,18 +5,44 @@ import (
 	"fmt"
 	"github.com/donovanhide/superfastmatch/registry"
 	"github.com/golang/glog"
+	"labix.org/v2/mgo/bson"
 	"math"
 	"net/url"
 	"sort"
+	"strconv"
 	"time"
 	"unicode/utf8"
 )
 
 type DocumentArg struct {
+	Exclusions
 	Id          *DocumentID
-	TargetRange string `schema:"target"`
-	Text        string `schema:"text"`
-	Limit       int    `schema:"limit"`
+	TargetRange string      `schema:"target"`
+	Text        string      `schema:"text"`
+	Limit       int         `schema:"limit"`
+	Offsets     bool        `schema:"offsets"`
+	Meta        MetaFilters `schema:"-"`
+	Index       string      `schema:"index"`
+}
+
+// Rules for leaving out matches from the same source as the searched document.
+// The own doctype and meta rules only apply when searching a stored document.
+type Exclusions struct {
+	ExcludeOwn  bool         `schema:"exclude_own"`
+	Exclude     DocTypeRange `schema:"exclude"`
+	ExcludeMeta []string     `schema:"exclude_meta"`
+}
+
+// Carries the text of a document before it was replaced, so that posting
+// servers can remove only the hashes which are no longer present.
+type UpdateArg struct {
+	DocumentArg
+	Previous string
+}
+
+// Identifies a batch of stored documents for the posting servers
+type DocumentsArg struct {
+	Ids []DocumentID
 }
 
 type SearchResult struct {
@@ -42,12 +68,36 @@ func NewDocumentArg(registry *registry.Registry, values url.Values) (*DocumentAr
 		Limit: 10,
 	}
 	decoder.Decode(d, values)
-	if uint64(utf8.RuneCountInString(d.Text)) < registry.WindowSize {
-		return nil, fmt.Errorf("text field less than %d unicode characters", registry.WindowSize)
+	index, err := registry.Index(d.Index)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(utf8.RuneCountInString(d.Text)) < index.WindowSize {
+		return nil, fmt.Errorf("text field less than %d unicode characters", index.WindowSize)
+	}
+	if d.Meta, err = ParseMetaFilters(values); err != nil {
+		return nil, err
 	}
 	return d, nil
 }
 
+func NewExclusions(values url.Values) Exclusions {
+	var e Exclusions
+	decoder.Decode(&e, values)
+	return e
+}
+
+func (e *Exclusions) selector(id *DocumentID) Selector {
+	excluded := string(e.Exclude)
+	if e.ExcludeOwn && id != nil {
+		if len(excluded) > 0 {
+			excluded += ":"
+		}
+		excluded += strconv.FormatUint(uint64(id.Doctype), 10)
+	}
+	return DocTypeRange(excluded).Selector()
+}
+
 func (a *DocumentArg) GetDocument(registry *registry.Registry) (*Document, error) {
 	if a.Id != nil {
 		return GetDocument(a.Id, registry)
@@ -55,6 +105,14 @@ func (a *DocumentArg) GetDocument(registry *registry.Registry) (*Document, error
 	return BuildDocument(0, 0, "", a.Text, nil)
 }
 
+func (a *DocumentsArg) GetDocuments(registry *registry.Registry) ([]*Document, error) {
+	return GetDocumentBatch(a.Ids, registry)
+}
+
+func (a *UpdateArg) GetPrevious() (*Document, error) {
+	return BuildDocument(a.Id.Doctype, a.Id.Docid, "", a.Previous, nil)
+}
+
 func (t *Tally) Mean() float64 {
 	return float64(t.SumDeltas) / float64(t.Count)
 }
@@ -86,11 +144,14 @@ type SearchGroup []SearchMap
 
 func (s *SearchGroup) Merge(doc *DocumentArg) MatchSlice {
 	merged := make(SearchMap)
-	intervals := DocTypeRange(doc.TargetRange).Intervals()
+	target, excluded := DocTypeRange(doc.TargetRange).Selector(), doc.selector(doc.Id)
 	for i, _ := range *s {
 		for k, v := range (*s)[i] {
-			// Filter by specified doctype range
-			if len(intervals) > 0 && !intervals.Contains(uint64(k.Doctype)) {
+			// Filter by specified target selector
+			if len(target) > 0 && !target.Contains(k) {
+				continue
+			}
+			if excluded.Contains(k) {
 				continue
 			}
 			if v.Count < 8 {
@@ -118,12 +179,75 @@ func (s *SearchGroup) Merge(doc *DocumentArg) MatchSlice {
 		i++
 	}
 	sort.Sort(matches)
-	if doc.Limit < len(matches) {
-		matches = matches[:doc.Limit]
-	}
 	return matches
 }
 
+// Removes matches whose stored metadata does not satisfy the filters
+func (m MatchSlice) FilterMeta(registry *registry.Registry, filters MetaFilters) (MatchSlice, error) {
+	if len(filters) == 0 || len(m) == 0 {
+		return m, nil
+	}
+	ids := make([]DocumentID, len(m))
+	for i := range m {
+		ids[i] = m[i].Id
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	query := filters.Query(bson.M{"_id": bson.M{"$in": ids}})
+	var doc Document
+	valid := make(map[DocumentID]bool)
+	iter := db.C("documents").Find(query).Select(bson.M{"_id": 1}).Iter()
+	for iter.Next(&doc) {
+		valid[doc.Id] = true
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	filtered := m[:0]
+	for i := range m {
+		if valid[m[i].Id] {
+			filtered = append(filtered, m[i])
+		}
+	}
+	return filtered, nil
+}
+
+// Removes matches which share a value of any of the fields with the document's metadata
+func (m MatchSlice) ExcludeMeta(registry *registry.Registry, doc *Document, fields []string) (MatchSlice, error) {
+	conditions := make([]bson.M, 0, len(fields))
+	for _, field := range fields {
+		if values := metaStrings(doc.Meta[field]); len(values) > 0 {
+			conditions = append(conditions, bson.M{metaPrefix + field: bson.M{"$in": values}})
+		}
+	}
+	if len(conditions) == 0 || len(m) == 0 {
+		return m, nil
+	}
+	ids := make([]DocumentID, len(m))
+	for i := range m {
+		ids[i] = m[i].Id
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	query := bson.M{"_id": bson.M{"$in": ids}, "$or": conditions}
+	var other Document
+	excluded := make(map[DocumentID]bool)
+	iter := db.C("documents").Find(query).Select(bson.M{"_id": 1}).Iter()
+	for iter.Next(&other) {
+		excluded[other.Id] = true
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	filtered := m[:0]
+	for i := range m {
+		if !excluded[m[i].Id] {
+			filtered = append(filtered, m[i])
+		}
+	}
+	return filtered, nil
+}
+
 func (m *MatchSlice) String() string {
 	var out bytes.Buffer
 	for _, v := range *m {
@@ -132,7 +256,9 @@ func (m *MatchSlice) String() string {
 	return out.String()
 }
 
-func (m MatchSlice) Fill(registry *registry.Registry, doc *Document) MatchSlice {
+// Associations are built with the window size of the searched index. If offsets
+// is true, each association reports the positions of its fragments in the original texts.
+func (m MatchSlice) Fill(registry *registry.Registry, windowSize uint64, doc *Document, save bool, offsets bool) (MatchSlice, error) {
 	fills := make(map[DocumentID]*Match)
 	docids := make([]DocumentID, len(m))
 	for i, _ := range m {
@@ -140,24 +266,55 @@ func (m MatchSlice) Fill(registry *registry.Registry, doc *Document) MatchSlice
 		fills[m[i].Id] = &m[i]
 	}
 	searchStart := time.Now()
+	var err error
 	for other := range GetDocumentsById(docids, registry) {
+		if err != nil {
+			continue
+		}
 		start := time.Now()
-		doc.AddAssociation(registry, other, false)
+		_, err = doc.addAssociation(registry, windowSize, other, save)
+		if a := doc.Associations.find(other.Id); err == nil && offsets && a != nil {
+			a.Offsets = a.Fragments.Offsets(doc, other)
+		}
 		glog.V(2).Infof("Document: %v Association Time:%.2fs\n", other, time.Now().Sub(start).Seconds())
 	}
 	glog.V(2).Infof("Search Time:%.2fs\n", time.Now().Sub(searchStart).Seconds())
-	return m
+	return m, err
 }
 
 func (s *SearchGroup) GetResult(registry *registry.Registry, d *DocumentArg, save bool) (*SearchResult, error) {
+	index, err := registry.Index(d.Index)
+	if err != nil {
+		return nil, err
+	}
 	doc, err := d.GetDocument(registry)
 	if err != nil {
 		return nil, err
 	}
-	results := s.Merge(d).Fill(registry, doc)
+	matches, err := s.Merge(d).FilterMeta(registry, d.Meta)
+	if err != nil {
+		return nil, err
+	}
+	if matches, err = matches.ExcludeMeta(registry, doc, d.ExcludeMeta); err != nil {
+		return nil, err
+	}
+	if d.Limit < len(matches) {
+		matches = matches[:d.Limit]
+	}
+	if save {
+		if err := doc.clearAssociations(registry, DocTypeRange(d.TargetRange)); err != nil {
+			return nil, err
+		}
+	}
+	results, err := matches.Fill(registry, index.WindowSize, doc, save, d.Offsets)
+	if err != nil {
+		return nil, err
+	}
 	glog.V(2).Infoln(results.String())
 	if save {
-		doc.Save(registry)
+		if err := doc.Save(registry); err != nil {
+			return nil, err
+		}
 	}
 	if d.Limit < len(results) {
 		results = results[:d.Limit]
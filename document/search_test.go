@@ -0,0 +1,29 @@
+package document
+
+import (
+	. "launchpad.net/gocheck"
+	"net/url"
+)
+
+type SearchSuite struct{}
+
+var _ = Suite(&SearchSuite{})
+
+func (s *SearchSuite) TestExclusions(c *C) {
+	tally := &Tally{Count: 10, SumDeltas: 20, SumSquareDeltas: 40}
+	group := SearchGroup{SearchMap{
+		DocumentID{1, 1}: tally,
+		DocumentID{1, 2}: tally,
+		DocumentID{2, 1}: tally,
+		DocumentID{3, 1}: tally,
+		DocumentID{4, 1}: tally,
+	}}
+	values, _ := url.ParseQuery("exclude_own=true&exclude=3-4&exclude_meta=source&exclude_meta=author")
+	arg := &DocumentArg{Id: &DocumentID{1, 1}, Exclusions: NewExclusions(values)}
+	c.Check(arg.ExcludeMeta, DeepEquals, []string{"source", "author"})
+	matches := group.Merge(arg)
+	c.Assert(matches, HasLen, 1)
+	c.Check(matches[0].Id, Equals, DocumentID{2, 1})
+	arg = &DocumentArg{Text: "text", Exclusions: Exclusions{ExcludeOwn: true}}
+	c.Check(group.Merge(arg), HasLen, 5)
+}
@@ -0,0 +1,189 @@
+package document
+
+import (
+	"github.com/donovanhide/superfastmatch/registry"
+	"github.com/golang/glog"
+	"labix.org/v2/mgo/bson"
+	"sort"
+	"strconv"
+)
+
+// The signature is split into bands of rows for locality sensitive hashing.
+// Documents sharing any band become candidates, which for 16 bands of 4 rows
+// finds pairs with a similarity of 0.5 about 65% of the time and 0.8 almost always.
+// Rather than an index held in the api process, the bands are stored with each
+// document and looked up through mongo's multikey index on them, so that the
+// api and every queue worker see the same index and it survives restarts.
+const (
+	signatureBands            = 16
+	signatureRows             = 4
+	signatureSize             = signatureBands * signatureRows
+	signatureHashWidth        = 32
+	defaultDuplicateThreshold = 0.9
+)
+
+var signatureSeeds = make([]uint32, signatureSize)
+
+func init() {
+	for i := range signatureSeeds {
+		signatureSeeds[i] = mix(uint32(i+1) * 0x9e3779b9)
+	}
+}
+
+// MinHash of the window hashes of the normalised text
+type Signature []uint32
+
+type Duplicate struct {
+	Id         DocumentID `json:"id"`
+	Similarity float64    `json:"similarity"`
+}
+
+type DuplicateSlice []Duplicate
+
+type DuplicateResult struct {
+	Success   bool           `json:"success"`
+	TotalRows int            `json:"totalRows"`
+	Rows      DuplicateSlice `json:"rows"`
+}
+
+func (s DuplicateSlice) Len() int           { return len(s) }
+func (s DuplicateSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s DuplicateSlice) Less(i, j int) bool { return s[i].Similarity > s[j].Similarity }
+
+func (d *Document) BuildSignature(windowSize uint64) Signature {
+	key := HashKey{WindowSize: windowSize, HashWidth: signatureHashWidth}
+	if d.HashLength(key) == 0 {
+		return nil
+	}
+	signature := make(Signature, signatureSize)
+	for i := range signature {
+		signature[i] = ^uint32(0)
+	}
+	ws := whiteSpaceHash(key)
+	for _, h := range d.Hashes(key) {
+		if h == ws {
+			continue
+		}
+		for i, seed := range signatureSeeds {
+			if v := mix(uint32(h) ^ seed); v < signature[i] {
+				signature[i] = v
+			}
+		}
+	}
+	return signature
+}
+
+// Estimates the Jaccard similarity of the window hashes of two documents
+func (s Signature) Similarity(other Signature) float64 {
+	if len(s) != signatureSize || len(other) != signatureSize {
+		return 0
+	}
+	same := 0
+	for i := range s {
+		if s[i] == other[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(signatureSize)
+}
+
+func (s Signature) bands() []uint64 {
+	bands := make([]uint64, signatureBands)
+	for i := range bands {
+		// FNV-1a over the band number and its rows
+		h := uint64(14695981039346656037) ^ uint64(i)
+		for _, v := range s[i*signatureRows : (i+1)*signatureRows] {
+			h = (h ^ uint64(v)) * 1099511628211
+		}
+		bands[i] = h
+	}
+	return bands
+}
+
+// The bands as stored with the document, where mongo finds the candidates
+func (s Signature) keys() []int64 {
+	bands := s.bands()
+	keys := make([]int64, len(bands))
+	for i := range bands {
+		keys[i] = int64(bands[i])
+	}
+	return keys
+}
+
+// Builds the signature and bands of a document stored without them
+func (d *Document) sign(windowSize uint64) {
+	if d.Signature == nil && len(d.Text) > 0 {
+		d.Signature = d.BuildSignature(windowSize)
+	}
+	if d.Bands == nil && len(d.Signature) == signatureSize {
+		d.Bands = d.Signature.keys()
+	}
+}
+
+// True when any document was stored before signatures and bands existed
+func SignaturesMissing(registry *registry.Registry) (bool, error) {
+	db := registry.DB()
+	defer db.Session.Close()
+	n, err := db.C("documents").Find(bson.M{"bands": bson.M{"$exists": false}}).Limit(1).Count()
+	return n > 0, err
+}
+
+// Computes the signatures and bands of documents stored before they existed
+func FillSignatures(registry *registry.Registry) error {
+	db := registry.DB()
+	defer db.Session.Close()
+	documents := db.C("documents")
+	computed := 0
+	missing := documents.Find(bson.M{"bands": bson.M{"$exists": false}}).Select(bson.M{"_id": 1, "text": 1, "length": 1, "signature": 1})
+	iter := missing.Iter()
+	for next := new(Document); iter.Next(next); next = new(Document) {
+		next.init().sign(registry.WindowSize)
+		if next.Bands == nil {
+			continue
+		}
+		if err := documents.UpdateId(next.Id, bson.M{"$set": bson.M{"signature": next.Signature, "bands": next.Bands}}); err != nil {
+			return err
+		}
+		computed++
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	glog.Infof("Computed %d signatures", computed)
+	return nil
+}
+
+func NewDuplicateThreshold(value string) float64 {
+	threshold, err := strconv.ParseFloat(value, 64)
+	if err != nil || threshold <= 0 || threshold > 1 {
+		return defaultDuplicateThreshold
+	}
+	return threshold
+}
+
+// Returns the stored documents similar to doc, excluding doc itself. Documents
+// sharing any band with doc are the candidates, found through the index on bands.
+func FindDuplicates(registry *registry.Registry, doc *Document, threshold float64) (*DuplicateResult, error) {
+	doc.sign(registry.WindowSize)
+	duplicates := make(DuplicateSlice, 0)
+	if doc.Bands != nil {
+		db := registry.DB()
+		defer db.Session.Close()
+		query := bson.M{"bands": bson.M{"$in": doc.Bands}, "_id": bson.M{"$ne": doc.Id}}
+		iter := db.C("documents").Find(query).Select(bson.M{"_id": 1, "signature": 1}).Iter()
+		for next := new(Document); iter.Next(next); next = new(Document) {
+			if similarity := doc.Signature.Similarity(next.Signature); similarity >= threshold {
+				duplicates = append(duplicates, Duplicate{Id: next.Id, Similarity: similarity})
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(duplicates)
+	return &DuplicateResult{
+		Success:   true,
+		TotalRows: len(duplicates),
+		Rows:      duplicates,
+	}, nil
+}
@@ -0,0 +1,61 @@
+package document
+
+import (
+	. "launchpad.net/gocheck"
+	"strings"
+)
+
+type SignatureSuite struct{}
+
+var _ = Suite(&SignatureSuite{})
+
+func signatureTexts() (string, string, string) {
+	words := strings.Fields("the quick brown fox jumps over a lazy dog while seven wizards quietly hex jovial boxers and five liquor jugs pack my box")
+	var original, different []string
+	for i := 0; i < 400; i++ {
+		original = append(original, words[(i*7)%len(words)]+words[(i*3)%len(words)])
+		different = append(different, words[(i*5)%len(words)]+words[(i*11+1)%len(words)]+"x")
+	}
+	edited := append([]string{}, original...)
+	edited[200] = "changed"
+	return strings.Join(original, " "), strings.Join(edited, " "), strings.Join(different, " ")
+}
+
+func (s *SignatureSuite) TestSimilarity(c *C) {
+	originalText, editedText, differentText := signatureTexts()
+	original, _ := BuildDocument(1, 1, "Original", originalText, nil)
+	edited, _ := BuildDocument(1, 2, "Edited", editedText, nil)
+	different, _ := BuildDocument(1, 3, "Different", differentText, nil)
+	c.Check(original.BuildSignature(30).Similarity(original.BuildSignature(30)), Equals, 1.0)
+	c.Check(original.BuildSignature(30).Similarity(edited.BuildSignature(30)) > 0.8, Equals, true)
+	c.Check(original.BuildSignature(30).Similarity(different.BuildSignature(30)) < 0.2, Equals, true)
+	short, _ := BuildDocument(1, 4, "Short", "too short", nil)
+	c.Check(short.BuildSignature(30), IsNil)
+}
+
+func sharesBand(a, b []int64) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *SignatureSuite) TestBands(c *C) {
+	originalText, editedText, differentText := signatureTexts()
+	original, _ := BuildDocument(1, 1, "", originalText, nil)
+	edited, _ := BuildDocument(1, 2, "", editedText, nil)
+	different, _ := BuildDocument(1, 3, "", differentText, nil)
+	for _, doc := range []*Document{original, edited, different} {
+		doc.sign(30)
+		c.Check(doc.Bands, HasLen, signatureBands)
+	}
+	c.Check(sharesBand(original.Bands, edited.Bands), Equals, true)
+	c.Check(sharesBand(original.Bands, different.Bands), Equals, false)
+	short, _ := BuildDocument(1, 4, "", "too short", nil)
+	short.sign(30)
+	c.Check(short.Bands, IsNil)
+}
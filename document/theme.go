@@ -0,0 +1,121 @@
+package document
+
+import (
+	"github.com/donovanhide/superfastmatch/registry"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/url"
+	"strconv"
+)
+
+type ThemeQueryParams struct {
+	QueryParams
+	Doctypes  DocTypeRange `schema:"doctypes"`
+	MinLength int          `schema:"min_length"`
+}
+
+type ThemeListResult struct {
+	Rows      []Theme `json:"rows"`
+	TotalRows int     `json:"totalRows"`
+}
+
+type ThemeInstance struct {
+	Source DocumentID `json:"source"`
+	Target DocumentID `json:"target"`
+	Left   int        `json:"left"`
+	Right  int        `json:"right"`
+	Length int        `json:"length"`
+}
+
+type ThemeResult struct {
+	Success   bool            `json:"success"`
+	Theme     *Theme          `json:"theme"`
+	Instances []ThemeInstance `json:"instances"`
+}
+
+func NewThemeId(value string) (ThemeId, error) {
+	id, err := strconv.ParseUint(value, 10, 64)
+	return ThemeId(id), err
+}
+
+// Themes which appear in at least one of the doctypes in the range
+func (r DocTypeRange) themeFilter() []bson.M {
+	intervals := r.Intervals()
+	filter := make([]bson.M, len(intervals))
+	for i, interval := range intervals {
+		filter[i] = bson.M{"doctypes": bson.M{"$elemMatch": bson.M{"$gte": interval.start, "$lte": interval.end}}}
+	}
+	return filter
+}
+
+func GetThemes(values *url.Values, registry *registry.Registry) (*ThemeListResult, error) {
+	q := new(ThemeQueryParams)
+	r := new(ThemeListResult)
+	decoder.Decode(q, *values)
+	q.Filter = bson.M{}
+	if len(q.Doctypes) > 0 {
+		q.Filter["$or"] = q.Doctypes.themeFilter()
+	}
+	if q.MinLength > 0 {
+		q.Filter["length"] = bson.M{"$gte": q.MinLength}
+	}
+	q.DefaultSort = []string{"-count", "-length"}
+	db := registry.DB()
+	defer db.Session.Close()
+	themes := q.getQuery(values, db.C("theme"))
+	if err := themes.All(&r.Rows); err != nil {
+		return nil, err
+	}
+	if err := fillResult(r, themes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Fills in the documents each theme occurs in
+func fillThemeDocuments(db *mgo.Database, themes []Theme) error {
+	ids, index := make([]ThemeId, len(themes)), make(map[ThemeId]int, len(themes))
+	for i, theme := range themes {
+		ids[i], index[theme.Id] = theme.Id, i
+	}
+	iter := db.C("theme_documents").Find(bson.M{"_id.theme": bson.M{"$in": ids}}).Iter()
+	var record struct {
+		Id themeDocument `bson:"_id"`
+	}
+	for iter.Next(&record) {
+		i := index[record.Id.Theme]
+		themes[i].Documents = append(themes[i].Documents, record.Id.Document)
+	}
+	return iter.Close()
+}
+
+// Returns the theme along with every fragment of a saved association which references it
+func GetTheme(id ThemeId, registry *registry.Registry) (*ThemeResult, error) {
+	r := &ThemeResult{
+		Success:   true,
+		Theme:     new(Theme),
+		Instances: make([]ThemeInstance, 0),
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	if err := db.C("theme").FindId(id).One(r.Theme); err != nil {
+		return nil, err
+	}
+	query := bson.M{"fragments.id": id}
+	iter := db.C("associations").Find(query).Select(bson.M{"_id": 1, "fragments": 1}).Iter()
+	var a AssociationRecord
+	for iter.Next(&a) {
+		for _, f := range a.Fragments {
+			if f.Id == id {
+				r.Instances = append(r.Instances, ThemeInstance{
+					Source: a.Id.Source,
+					Target: a.Id.Target,
+					Left:   f.Left,
+					Right:  f.Right,
+					Length: f.Length,
+				})
+			}
+		}
+	}
+	return r, iter.Close()
+}
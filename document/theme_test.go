@@ -0,0 +1,44 @@
+package document
+
+import (
+	"github.com/donovanhide/superfastmatch/testutils"
+	. "launchpad.net/gocheck"
+)
+
+type ThemeSuite struct {
+	testutils.DBSuite
+}
+
+var _ = Suite(&ThemeSuite{})
+
+func (s *ThemeSuite) TestGetThemes(c *C) {
+	left, _ := BuildDocument(1, 1, "Left", openFile("../../fixtures/gutenberg/bible.txt.gz"), nil)
+	right, _ := BuildDocument(2, 1, "Right", openFile("../../fixtures/gutenberg/koran.txt.gz"), nil)
+	association, themes := BuildAssociation(30, left, right)
+	c.Assert(len(themes) > 0, Equals, true)
+	c.Assert(themes.Save(s.Registry, left.Id, right.Id), IsNil)
+	values := buildValues("GET", "http://testing.com/?limit=5", "2")
+	results, err := GetThemes(values, s.Registry)
+	c.Assert(err, IsNil)
+	c.Check(results.TotalRows, Equals, len(themes))
+	c.Check(len(results.Rows), Equals, 5)
+	c.Check(results.Rows[0].Doctypes, DeepEquals, []uint32{1, 2})
+	c.Check(results.Rows[0].Count, Equals, 2)
+	c.Assert(themes.Save(s.Registry, left.Id, right.Id), IsNil)
+	results, err = GetThemes(values, s.Registry)
+	c.Assert(err, IsNil)
+	c.Check(results.Rows[0].Count, Equals, 2)
+	db := s.Registry.DB()
+	defer db.Session.Close()
+	c.Check(fillThemeDocuments(db, results.Rows[:1]), IsNil)
+	c.Check(results.Rows[0].Documents, HasLen, 2)
+	values = buildValues("GET", "http://testing.com/?min_length=40", "3")
+	results, err = GetThemes(values, s.Registry)
+	c.Assert(err, IsNil)
+	c.Check(results.TotalRows, Equals, 0)
+	c.Assert(association.Save(s.Registry, left.Id), IsNil)
+	theme, err := GetTheme(association.Fragments[0].Id, s.Registry)
+	c.Assert(err, IsNil)
+	c.Check(len(theme.Instances) > 0, Equals, true)
+	c.Check(theme.Instances[0].Target, Equals, right.Id)
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"strings"
+	"sync"
 	"unicode"
 )
 
@@ -14,6 +15,7 @@ const base uint64 = 37
 var bases = make([][]uint64, maxWindowSize+1)
 var words []string
 var whiteSpaceHashes = make(map[HashKey]uint64, maxWindowSize+1)
+var whiteSpaceLock sync.Mutex
 
 type StreamFunc func(i int, h uint64)
 type HasherFunc func(text string, length uint64, key HashKey, f StreamFunc)
@@ -41,6 +43,8 @@ func min(a, b int) int {
 }
 
 func whiteSpaceHash(hashKey HashKey) uint64 {
+	whiteSpaceLock.Lock()
+	defer whiteSpaceLock.Unlock()
 	hash, ok := whiteSpaceHashes[hashKey]
 	if ok {
 		return hash
@@ -145,6 +149,26 @@ func normaliseRune(r rune) rune {
 	return whiteSpace
 }
 
+// Walks text calling f with each rune of the normalised text and the offset
+// of the original rune it was derived from. Returns the offset of the end of
+// the text. Both the normalised text and the offset map are built from this,
+// so they remain consistent however normalisation changes.
+func normalise(text string, f func(r rune, o Offset)) Offset {
+	var o Offset
+	for i, r := range text {
+		o.Byte = int32(i)
+		f(normaliseRune(r), o)
+		o.Rune++
+		if r >= 0x10000 {
+			o.UTF16 += 2
+		} else {
+			o.UTF16++
+		}
+	}
+	o.Byte = int32(len(text))
+	return o
+}
+
 func BuildTestCorpus(maxDoctype uint32, maxDocid uint32, maxLength int) chan *Document {
 	docs := make(chan *Document, 100)
 	go func() {
@@ -10,10 +10,11 @@ import (
 
 var decoder = schema.NewDecoder()
 
+// Writes go to the posting servers of every index, searches only to those of the selected index
 type Client struct {
 	clients  []*rpc.Client
 	registry *registry.Registry
-	// configs  []registry.PostingConfig
+	configs  []registry.PostingConfig
 }
 
 type Query struct {
@@ -43,6 +44,7 @@ type Doctype struct {
 func NewClient(registry *registry.Registry) (*Client, error) {
 	p := &Client{
 		registry: registry,
+		configs:  registry.PostingConfigs,
 	}
 	p.clients = make([]*rpc.Client, len(registry.PostingConfigs))
 	var err error
@@ -75,13 +77,29 @@ func (p *Client) Close() {
 	}
 }
 
+// The clients of the posting servers belonging to the index
+func (p *Client) indexClients(index *registry.IndexConfig) []*rpc.Client {
+	clients := make([]*rpc.Client, 0, len(index.Addresses))
+	for i, config := range p.configs {
+		if config.Index == index.Name {
+			clients = append(clients, p.clients[i])
+		}
+	}
+	return clients
+}
+
 func (p *Client) Search(d *document.DocumentArg) (*document.SearchGroup, error) {
-	result := make(document.SearchGroup, len(p.clients))
-	done := make(chan *rpc.Call, len(p.clients))
-	for i, _ := range p.clients {
-		p.clients[i].Go("Posting.Search", d, &result[i], done)
+	index, err := p.registry.Index(d.Index)
+	if err != nil {
+		return nil, err
 	}
-	for _, _ = range p.clients {
+	clients := p.indexClients(index)
+	result := make(document.SearchGroup, len(clients))
+	done := make(chan *rpc.Call, len(clients))
+	for i, _ := range clients {
+		clients[i].Go("Posting.Search", d, &result[i], done)
+	}
+	for _, _ = range clients {
 		replyCall := <-done
 		if replyCall.Error != nil {
 			return nil, replyCall.Error
@@ -105,14 +123,16 @@ func (p *Client) CallMultiple(service string, args interface{}) error {
 	return nil
 }
 
-func (p *Client) GetRows(values *url.Values) (*ListResult, error) {
+// Lists the rows of the posting servers belonging to the index
+func (p *Client) GetRows(index *registry.IndexConfig, values *url.Values) (*ListResult, error) {
 	result := Query{
 		Start: 0,
 		Limit: 100,
 	}
 	decoder.Decode(&result, *values)
-	for i, _ := range p.clients {
-		if err := p.clients[i].Call("Posting.List", result, &result); err != nil {
+	clients := p.indexClients(index)
+	for i, _ := range clients {
+		if err := clients[i].Call("Posting.List", result, &result); err != nil {
 			return nil, err
 		}
 		if len(result.Result.Rows) >= result.Limit {
@@ -253,6 +253,28 @@ func (p *PostingLine) AddDocumentId(id *document.DocumentID) bool {
 	return changed
 }
 
+// Removes every selected document, re-encoding the line after each removal.
+// Returns true if any were removed.
+func (p *PostingLine) RemoveSelected(selector document.Selector) bool {
+	selected := make([]document.DocumentID, 0)
+	for i, h := uint32(0), p.headers.Front(); i < p.count; h = h.Next() {
+		i++
+		header := h.Value.(*Header)
+		for _, docid := range header.Docids() {
+			if id := (document.DocumentID{Doctype: header.Doctype, Docid: docid}); selector.Contains(id) {
+				selected = append(selected, id)
+			}
+		}
+	}
+	for i := range selected {
+		p.RemoveDocumentId(&selected[i])
+		buf := make([]byte, p.Length)
+		p.Read(buf)
+		p.Write(buf)
+	}
+	return len(selected) > 0
+}
+
 func NewPostingLine() *PostingLine {
 	p := PostingLine{
 		Length: 1,
@@ -298,7 +320,8 @@ func (p *PostingLine) Read(b []byte) (int, error) {
 	return pos, io.EOF
 }
 
-func (p *PostingLine) FillMap(m *document.SearchMap, pos uint32) {
+// Documents with a doctype in the ignored scope are not tallied
+func (p *PostingLine) FillMap(m *document.SearchMap, pos uint32, ignored *document.IgnoreScope) {
 	if p.count == 0 {
 		return
 	}
@@ -307,6 +330,9 @@ func (p *PostingLine) FillMap(m *document.SearchMap, pos uint32) {
 		i++
 		header := h.Value.(*Header)
 		doctype := header.Doctype
+		if ignored.Contains(doctype) {
+			continue
+		}
 		for _, docid := range header.Docids() {
 			id := document.DocumentID{Doctype: doctype, Docid: docid}
 			if tally, ok := (*m)[id]; ok {
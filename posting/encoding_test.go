@@ -43,6 +43,32 @@ func (s *PostingSuite) TestLineLength(c *C) {
 	buf = CheckLine(c, line, buf, 3, 0, 25)
 }
 
+func buildLine(ids ...document.DocumentID) []byte {
+	line := NewPostingLine()
+	for i := range ids {
+		line.AddDocumentId(&ids[i])
+		buf := make([]byte, line.Length)
+		line.Read(buf)
+		line.Write(buf)
+	}
+	buf := make([]byte, line.Length)
+	line.Read(buf)
+	return buf
+}
+
+func (s *PostingSuite) TestRemoveSelected(c *C) {
+	id := func(doctype, docid uint32) document.DocumentID {
+		return document.DocumentID{Doctype: doctype, Docid: docid}
+	}
+	line := NewPostingLine()
+	line.Write(buildLine(id(1, 1), id(1, 5), id(2, 3), id(3, 7), id(3, 8)))
+	c.Check(line.RemoveSelected(document.DocTypeRange("1/5:3").Selector()), Equals, true)
+	c.Check(line.RemoveSelected(document.DocTypeRange("4").Selector()), Equals, false)
+	buf := make([]byte, line.Length)
+	line.Read(buf)
+	c.Check(buf, DeepEquals, buildLine(id(1, 1), id(2, 3)))
+}
+
 func (s *PostingSuite) TestLineLengthSpecificExample(c *C) {
 	line := NewPostingLine()
 	buf := make([]byte, 0)
@@ -16,13 +16,39 @@ import (
 )
 
 type Posting struct {
-	lock      sync.RWMutex
-	hashKey   document.HashKey
-	offset    uint64
-	size      uint64
-	documents uint64
-	registry  *registry.Registry
-	table     *sparsetable.SparseTable
+	lock        sync.RWMutex
+	reindexLock sync.Mutex
+	hashKey     document.HashKey
+	offset      uint64
+	size        uint64
+	documents   uint64
+	registry    *registry.Registry
+	conf        *registry.PostingConfig
+	table       *sparsetable.SparseTable
+	shadow      *sparsetable.SparseTable
+	pending     []change
+	beginning   map[document.DocumentID]bool
+	touched     map[document.DocumentID]bool
+	reindex     string
+}
+
+// A change to the table which is repeated on the shadow table
+type change func(table *sparsetable.SparseTable)
+
+// Rebuilds the documents selected by Range, or every document if it is empty.
+// With Shadow the documents are rebuilt in a copy of the table which replaces
+// it when the reindex ends, otherwise they are missing from searches until
+// they have been added again. Id identifies the reindex, a later one
+// supersedes any still running.
+type ReindexArg struct {
+	Id     string
+	Range  document.DocTypeRange
+	Shadow bool
+}
+
+type ReindexDocumentsArg struct {
+	document.DocumentsArg
+	Id string
 }
 
 func newPostingError(s string, err error) error {
@@ -55,6 +81,11 @@ func (s *Stats) Valid() bool {
 	return (s.ops + s.dupes) == s.count
 }
 
+// True when the document was already in the state the operation leaves it in
+func (s *Stats) Unchanged() bool {
+	return s.ops == 0 && s.dupes > 0
+}
+
 func (s *Stats) String() string {
 	return fmt.Sprintf("%v Hashes: %v/%v Ignored: %.2f%% Saturated: %.2f%% Dupes: %.2f%% Speed: %.0f hashes/sec",
 		s.doc.Id.String(),
@@ -66,25 +97,15 @@ func (s *Stats) String() string {
 		float64(s.ops)/time.Now().Sub(s.start).Seconds())
 }
 
-func (p *Posting) alter(operation int, doc *document.Document) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = r.(error)
-		}
-	}()
+func (p *Posting) alterFunc(table *sparsetable.SparseTable, operation int, doc *document.Document, stats *Stats) document.StreamFunc {
 	l := NewPostingLine()
-	stats := &Stats{
-		doc:    doc,
-		start:  time.Now(),
-		length: doc.HashLength(p.hashKey),
-	}
-	alterFunc := func(i int, hash uint64) {
+	return func(i int, hash uint64) {
 		pos := hash - p.offset
 		if pos >= p.size {
 			return
 		}
 		stats.count++
-		if err := p.table.Get(pos, l); err != nil {
+		if err := table.Get(pos, l); err != nil {
 			glog.Fatalln(newPostingError("Alter Document: Sparsetable Get:", err))
 		}
 		var err error
@@ -94,7 +115,7 @@ func (p *Posting) alter(operation int, doc *document.Document) (err error) {
 				stats.dupes++
 				return
 			}
-			err = p.table.Set(pos, l, l.Length)
+			err = table.Set(pos, l, l.Length)
 		case Delete:
 			if !l.RemoveDocumentId(&doc.Id) {
 				stats.dupes++
@@ -104,7 +125,7 @@ func (p *Posting) alter(operation int, doc *document.Document) (err error) {
 			if _, err := l.Read(buf); err != nil && err != io.EOF {
 				glog.Fatalln(newPostingError("Alter Document: Buffered Delete:", err))
 			}
-			err = p.table.Set(pos, bytes.NewReader(buf), l.Length)
+			err = table.Set(pos, bytes.NewReader(buf), l.Length)
 		}
 		if err != nil {
 			if serr, ok := err.(*sparsetable.Error); ok {
@@ -120,18 +141,150 @@ func (p *Posting) alter(operation int, doc *document.Document) (err error) {
 		}
 		stats.ops++
 	}
-	doc.ApplyHasher(p.hashKey, alterFunc)
-	switch operation {
-	case Add:
+}
+
+func (p *Posting) alter(operation int, doc *document.Document) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	stats := &Stats{
+		doc:    doc,
+		start:  time.Now(),
+		length: doc.HashLength(p.hashKey),
+	}
+	doc.ApplyHasher(p.hashKey, p.alterFunc(p.table, operation, doc, stats))
+	p.touch(doc.Id)
+	p.shadowed(func(table *sparsetable.SparseTable) {
+		doc.ApplyHasher(p.hashKey, p.alterFunc(table, operation, doc, &Stats{doc: doc, start: time.Now()}))
+	})
+	switch {
+	case stats.Unchanged():
+		glog.V(2).Infoln("Unchanged Document:", stats.String())
+	case operation == Add:
 		glog.V(2).Infoln("Added Document:", stats.String())
 		p.documents++
-	case Delete:
+	case operation == Delete:
 		glog.V(2).Infoln("Deleted Document:", stats.String())
 		p.documents--
 	}
 	return nil
 }
 
+// Only the hashes which differ between the previous and current text are
+// altered, unless a reindex may have cleared the document from the table, in
+// which case every hash of the previous text is removed and of the current
+// text added.
+func (p *Posting) update(previous *document.Document, doc *document.Document) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	removed, added := hashDifference(previous.Hashes(p.hashKey), doc.Hashes(p.hashKey))
+	if p.reindexing() {
+		removed, added = previous.Hashes(p.hashKey), doc.Hashes(p.hashKey)
+	}
+	stats := &Stats{
+		doc:    doc,
+		start:  time.Now(),
+		length: uint64(len(removed) + len(added)),
+	}
+	p.alterHashes(p.table, doc, removed, added, stats)
+	p.touch(doc.Id)
+	p.shadowed(func(table *sparsetable.SparseTable) {
+		p.alterHashes(table, doc, removed, added, &Stats{doc: doc, start: time.Now()})
+	})
+	glog.V(2).Infof("Updated Document: Removed: %d Added: %d %s", len(removed), len(added), stats.String())
+	return nil
+}
+
+func (p *Posting) alterHashes(table *sparsetable.SparseTable, doc *document.Document, removed, added []uint64, stats *Stats) {
+	remove, add := p.alterFunc(table, Delete, doc, stats), p.alterFunc(table, Add, doc, stats)
+	for i, hash := range removed {
+		remove(i, hash)
+	}
+	for i, hash := range added {
+		add(i, hash)
+	}
+}
+
+// During a shadowed reindex every change is written twice, so that the shadow
+// table has the changes made to documents outside the range, and to those
+// inside it which have already been rebuilt, when it is swapped in. While the
+// shadow is still being built the change is kept until it is ready.
+func (p *Posting) shadowed(c change) {
+	switch {
+	case p.shadow != nil:
+		c(p.shadow)
+	case p.pending != nil:
+		p.pending = append(p.pending, c)
+	}
+}
+
+func (p *Posting) reindexing() bool {
+	return p.touched != nil || p.beginning != nil
+}
+
+// Documents changed once a reindex has begun are not rebuilt by it, as the
+// batch they are read in may be older than the change.
+func (p *Posting) touch(id document.DocumentID) {
+	if p.touched != nil {
+		p.touched[id] = true
+	}
+	if p.beginning != nil {
+		p.beginning[id] = true
+	}
+}
+
+func (p *Posting) replay(table *sparsetable.SparseTable) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	for _, c := range p.pending {
+		c(table)
+	}
+	return nil
+}
+
+// Removes the selected documents from every line of the table
+func (p *Posting) clear(table *sparsetable.SparseTable, selector document.Selector) error {
+	l := NewPostingLine()
+	for pos := uint64(0); pos < p.size; pos++ {
+		if err := table.Get(pos, l); err != nil {
+			return err
+		}
+		if !l.RemoveSelected(selector) {
+			continue
+		}
+		buf := make([]byte, l.Length)
+		l.Read(buf)
+		if err := table.SetBytes(pos, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Documents are added to the shadow table during a reindex, otherwise to
+// the table itself. The document count is corrected when the reindex ends.
+func (p *Posting) rebuild(doc *document.Document) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	table := p.table
+	if p.shadow != nil {
+		table = p.shadow
+	}
+	doc.ApplyHasher(p.hashKey, p.alterFunc(table, Add, doc, &Stats{doc: doc, start: time.Now()}))
+	return nil
+}
+
 func (p *Posting) search(doc *document.Document, results *document.SearchMap) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -145,17 +298,22 @@ func (p *Posting) search(doc *document.Document, results *document.SearchMap) (e
 	}
 	l := NewPostingLine()
 	*results = make(document.SearchMap)
+	ignored := document.IgnoredHashes(p.hashKey)
 	searchFunc := func(i int, hash uint64) {
 		pos := hash - p.offset
 		if pos >= p.size {
 			return
 		}
 		stats.count++
+		scope := ignored[hash]
+		if scope.Contains(doc.Id.Doctype) {
+			return
+		}
 		if err := p.table.Get(pos, l); err != nil {
 			glog.Fatalln(newPostingError("Search Document: Sparsetable Get:", err))
 		}
 		stats.ops++
-		l.FillMap(results, uint32(i))
+		l.FillMap(results, uint32(i), scope)
 	}
 	doc.ApplyHasher(p.hashKey, searchFunc)
 	glog.Infoln("Searched Document: ", stats.String())
@@ -164,7 +322,8 @@ func (p *Posting) search(doc *document.Document, results *document.SearchMap) (e
 
 func (p *Posting) init(conf *registry.PostingConfig, c chan *document.Document) error {
 	start := time.Now()
-	p.table = sparsetable.Init(conf.Size, conf.GroupSize)
+	p.conf = conf
+	p.table, p.shadow, p.reindex = sparsetable.Init(conf.Size, conf.GroupSize), nil, ""
 	p.hashKey = document.HashKey{
 		HashWidth:  conf.HashWidth,
 		WindowSize: conf.WindowSize,
@@ -194,6 +353,9 @@ load:
 }
 
 func (p *Posting) Init(conf *registry.PostingConfig, reply *bool) error {
+	if err := document.LoadIgnores(p.registry); err != nil {
+		return newPostingError("Load Ignores:", err)
+	}
 	docids, err := document.GetDocids(conf.InitialQuery, p.registry)
 	if err != nil {
 		return newPostingError("Get Document:", err)
@@ -214,6 +376,38 @@ func (p *Posting) Add(arg *document.DocumentArg, _ *struct{}) error {
 	return p.alter(Add, doc)
 }
 
+// Adds a batch of documents while holding the lock once
+func (p *Posting) AddMultiple(arg *document.DocumentsArg, _ *struct{}) error {
+	docs, err := arg.GetDocuments(p.registry)
+	if err != nil {
+		return newPostingError("Add Documents:", err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, doc := range docs {
+		if err := p.alter(Add, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes a batch of documents while holding the lock once
+func (p *Posting) DeleteMultiple(arg *document.DocumentsArg, _ *struct{}) error {
+	docs, err := arg.GetDocuments(p.registry)
+	if err != nil {
+		return newPostingError("Delete Documents:", err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, doc := range docs {
+		if err := p.alter(Delete, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (p *Posting) Delete(arg *document.DocumentArg, _ *struct{}) error {
 	doc, err := arg.GetDocument(p.registry)
 	if err != nil {
@@ -224,6 +418,22 @@ func (p *Posting) Delete(arg *document.DocumentArg, _ *struct{}) error {
 	return p.alter(Delete, doc)
 }
 
+// Holds the write lock while both removing and adding hashes, so that
+// concurrent searches never see a partially updated document.
+func (p *Posting) Update(arg *document.UpdateArg, _ *struct{}) error {
+	doc, err := arg.GetDocument(p.registry)
+	if err != nil {
+		return newPostingError("Update Document:", err)
+	}
+	previous, err := arg.GetPrevious()
+	if err != nil {
+		return newPostingError("Update Document:", err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.update(previous, doc)
+}
+
 func (p *Posting) Search(arg *document.DocumentArg, result *document.SearchMap) error {
 	doc, err := arg.GetDocument(p.registry)
 	if err != nil {
@@ -234,6 +444,121 @@ func (p *Posting) Search(arg *document.DocumentArg, result *document.SearchMap)
 	return p.search(doc, result)
 }
 
+// A shadow table is copied under the read lock, so searches carry on, and
+// cleared without any lock, as nothing else refers to it yet. Changes made in
+// the meantime are replayed on it under the write lock, just before it is
+// swapped in. Without a shadow the selected documents are cleared from the
+// table itself under the write lock.
+func (p *Posting) BeginReindex(arg *ReindexArg, _ *struct{}) error {
+	if !arg.Range.Valid() {
+		return newPostingError("Begin Reindex:", fmt.Errorf("Bad range: %s", arg.Range))
+	}
+	p.reindexLock.Lock()
+	defer p.reindexLock.Unlock()
+	var table *sparsetable.SparseTable
+	switch {
+	case len(arg.Range) == 0:
+		table = sparsetable.Init(p.conf.Size, p.conf.GroupSize)
+	case arg.Shadow:
+		p.lock.RLock()
+		table = p.table.Copy()
+		// Nothing else changes the table or the pending changes until the read lock is released
+		p.pending, p.beginning = make([]change, 0), make(map[document.DocumentID]bool)
+		p.lock.RUnlock()
+		if err := p.clear(table, arg.Range.Selector()); err != nil {
+			p.lock.Lock()
+			p.pending, p.beginning = nil, nil
+			p.lock.Unlock()
+			return newPostingError("Begin Reindex:", err)
+		}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.reindex != "" {
+		glog.Warningf("Reindex %s superseded by %s", p.reindex, arg.Id)
+	}
+	p.shadow, p.reindex, p.touched = nil, "", nil
+	touched := make(map[document.DocumentID]bool)
+	switch {
+	case table == nil:
+		if err := p.clear(p.table, arg.Range.Selector()); err != nil {
+			return newPostingError("Begin Reindex:", err)
+		}
+	case arg.Shadow:
+		err := p.replay(table)
+		touched, p.pending, p.beginning = p.beginning, nil, nil
+		if err != nil {
+			return newPostingError("Begin Reindex:", err)
+		}
+		p.shadow = table
+	default:
+		p.table = table
+	}
+	p.reindex, p.touched = arg.Id, touched
+	glog.Infof("Begun Reindex %s Range: %q Shadow: %v", arg.Id, arg.Range, arg.Shadow)
+	return nil
+}
+
+// Adds a batch of documents to the table being rebuilt, apart from those
+// changed since the reindex began
+func (p *Posting) Reindex(arg *ReindexDocumentsArg, _ *struct{}) error {
+	docs, err := arg.GetDocuments(p.registry)
+	if err != nil {
+		return newPostingError("Reindex:", err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.reindex != arg.Id {
+		return newPostingError("Reindex:", fmt.Errorf("Reindex %s is not running", arg.Id))
+	}
+	for _, doc := range docs {
+		if p.touched[doc.Id] {
+			continue
+		}
+		if err := p.rebuild(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Swaps in the shadow table, if there is one
+func (p *Posting) EndReindex(arg *ReindexArg, _ *struct{}) error {
+	count, err := document.CountDocuments(p.conf.InitialQuery, p.registry)
+	if err != nil {
+		return newPostingError("End Reindex:", err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.reindex != arg.Id {
+		return newPostingError("End Reindex:", fmt.Errorf("Reindex %s is not running", arg.Id))
+	}
+	if p.shadow != nil {
+		p.table = p.shadow
+	}
+	p.shadow, p.reindex, p.touched, p.documents = nil, "", nil, uint64(count.Count)
+	glog.Infof("Ended Reindex %s with %d documents", arg.Id, p.documents)
+	return nil
+}
+
+// Drops the shadow table. Documents cleared from the table itself are not restored.
+func (p *Posting) AbortReindex(arg *ReindexArg, _ *struct{}) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.reindex == arg.Id {
+		p.shadow, p.reindex, p.touched = nil, "", nil
+	}
+	return nil
+}
+
+// Reloads the ignored passages after they have been changed through the API
+func (p *Posting) LoadIgnores(_ *bool, _ *struct{}) error {
+	if err := document.LoadIgnores(p.registry); err != nil {
+		return newPostingError("Load Ignores:", err)
+	}
+	return nil
+}
+
 func (p *Posting) List(in Query, out *Query) error {
 	out.Start = in.Start
 	out.Limit = in.Limit
@@ -34,6 +34,20 @@ func (s *PostingSuite) TestSimpleAddDocument(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *PostingSuite) TestReaddDocument(c *C) {
+	p := newPosting(s.Registry, "test")
+	p.Init(&s.Registry.PostingConfigs[0], nil)
+	doc, _ := document.BuildDocument(1, 1, "Document", document.RandomWords(120), nil)
+	c.Assert(doc.Save(s.Registry), IsNil)
+	arg := &document.DocumentsArg{Ids: []document.DocumentID{doc.Id}}
+	c.Assert(p.AddMultiple(arg, nil), IsNil)
+	c.Assert(p.AddMultiple(arg, nil), IsNil)
+	c.Check(p.documents, Equals, uint64(1))
+	c.Assert(p.Delete(&document.DocumentArg{Id: &doc.Id}, nil), IsNil)
+	c.Assert(p.Delete(&document.DocumentArg{Id: &doc.Id}, nil), IsNil)
+	c.Check(p.documents, Equals, uint64(0))
+}
+
 func buildDocuments(s *PostingSuite, c *C) []*document.DocumentID {
 	ids := make([]*document.DocumentID, docCount)
 	for i := 0; i < docCount; i++ {
@@ -104,3 +118,82 @@ func (s *PostingSuite) TestTemporarySearch(c *C) {
 	// c.Check(len(results.), Equals, 0)
 	c.Assert(err, IsNil)
 }
+
+func (s *PostingSuite) TestUpdateDocument(c *C) {
+	p := newPosting(s.Registry, "test")
+	p.Init(&s.Registry.PostingConfigs[0], nil)
+	shared, original, replacement := document.RandomWords(200), document.RandomWords(200), document.RandomWords(200)
+	doc, _ := document.BuildDocument(1, 1, "Original", shared+original, nil)
+	c.Assert(doc.Save(s.Registry), IsNil)
+	c.Assert(p.Add(&document.DocumentArg{Id: &doc.Id}, nil), IsNil)
+	updated, _ := document.BuildDocument(1, 1, "Replacement", shared+replacement, nil)
+	c.Assert(updated.Save(s.Registry), IsNil)
+	arg := &document.UpdateArg{DocumentArg: document.DocumentArg{Id: &doc.Id}, Previous: doc.Text}
+	c.Assert(p.Update(arg, nil), IsNil)
+	c.Check(p.documents, Equals, uint64(1))
+	for text, found := range map[string]bool{original: false, replacement: true, shared: true} {
+		result := make(document.SearchMap)
+		c.Assert(p.Search(&document.DocumentArg{Text: text}, &result), IsNil)
+		c.Check(result[doc.Id] != nil, Equals, found)
+	}
+}
+
+func (s *PostingSuite) TestReindex(c *C) {
+	p := newPosting(s.Registry, "test")
+	p.Init(&s.Registry.PostingConfigs[0], nil)
+	text := document.RandomWords(200)
+	ids := make([]document.DocumentID, 0)
+	for i := uint32(1); i <= 3; i++ {
+		doc, _ := document.BuildDocument(i, 1, "Document", text, nil)
+		c.Assert(doc.Save(s.Registry), IsNil)
+		c.Assert(p.Add(&document.DocumentArg{Id: &doc.Id}, nil), IsNil)
+		ids = append(ids, doc.Id)
+	}
+	found := func() map[document.DocumentID]bool {
+		result := make(document.SearchMap)
+		c.Assert(p.Search(&document.DocumentArg{Text: text}, &result), IsNil)
+		f := make(map[document.DocumentID]bool)
+		for _, id := range ids {
+			f[id] = result[id] != nil
+		}
+		return f
+	}
+	all := map[document.DocumentID]bool{ids[0]: true, ids[1]: true, ids[2]: true}
+	arg := &ReindexArg{Id: "shadow", Range: "2-3", Shadow: true}
+	c.Assert(p.BeginReindex(arg, nil), IsNil)
+	c.Check(found(), DeepEquals, all)
+	batch := &ReindexDocumentsArg{DocumentsArg: document.DocumentsArg{Ids: ids[1:2]}, Id: "shadow"}
+	c.Assert(p.Reindex(batch, nil), IsNil)
+	c.Check(p.Reindex(&ReindexDocumentsArg{Id: "other"}, nil), NotNil)
+	c.Assert(p.EndReindex(arg, nil), IsNil)
+	c.Check(found(), DeepEquals, map[document.DocumentID]bool{ids[0]: true, ids[1]: true, ids[2]: false})
+	arg = &ReindexArg{Id: "inplace", Range: "1"}
+	c.Assert(p.BeginReindex(arg, nil), IsNil)
+	c.Check(found()[ids[0]], Equals, false)
+	c.Assert(p.AbortReindex(arg, nil), IsNil)
+	c.Check(p.EndReindex(arg, nil), NotNil)
+	// Changes made while the shadow is being built are replayed on it
+	shadow := p.table.Copy()
+	doc, _ := document.BuildDocument(2, 1, "Document", text, nil)
+	p.pending = make([]change, 0)
+	c.Assert(p.alter(Delete, doc), IsNil)
+	c.Check(p.pending, HasLen, 1)
+	c.Assert(p.replay(shadow), IsNil)
+	p.table, p.pending = shadow, nil
+	c.Check(found()[ids[1]], Equals, false)
+	// A document deleted during a reindex is not restored by a batch read before its removal
+	c.Assert(p.Add(&document.DocumentArg{Id: &ids[2]}, nil), IsNil)
+	arg = &ReindexArg{Id: "deleted", Range: "3", Shadow: true}
+	c.Assert(p.BeginReindex(arg, nil), IsNil)
+	c.Assert(p.Delete(&document.DocumentArg{Id: &ids[2]}, nil), IsNil)
+	batch = &ReindexDocumentsArg{DocumentsArg: document.DocumentsArg{Ids: ids[2:]}, Id: "deleted"}
+	c.Assert(p.Reindex(batch, nil), IsNil)
+	c.Assert(p.EndReindex(arg, nil), IsNil)
+	c.Check(found()[ids[2]], Equals, false)
+}
+
+func (s *PostingSuite) TestHashDifference(c *C) {
+	removed, added := hashDifference([]uint64{1, 2, 3, 3, 4}, []uint64{3, 4, 5, 5, 6})
+	c.Check(removed, DeepEquals, []uint64{1, 2})
+	c.Check(added, DeepEquals, []uint64{5, 6})
+}
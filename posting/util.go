@@ -24,6 +24,27 @@ func SortedKeys(i interface{}) []uint32 {
 	return keys
 }
 
+// Returns the distinct hashes only in previous and the distinct hashes only in current
+func hashDifference(previous, current []uint64) (removed, added []uint64) {
+	before, after := make(map[uint64]bool, len(previous)), make(map[uint64]bool, len(current))
+	for _, h := range previous {
+		before[h] = true
+	}
+	for _, h := range current {
+		if !before[h] && !after[h] {
+			added = append(added, h)
+		}
+		after[h] = true
+	}
+	for _, h := range previous {
+		if !after[h] {
+			removed = append(removed, h)
+			after[h] = true
+		}
+	}
+	return removed, added
+}
+
 // Mock up a set of uint32
 type UInt32Set map[uint32]interface{}
 
@@ -0,0 +1,550 @@
+package queue
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/donovanhide/superfastmatch/document"
+	"github.com/donovanhide/superfastmatch/posting"
+	"github.com/donovanhide/superfastmatch/registry"
+	"io"
+	"io/ioutil"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	bulkBatchSize = 100
+	maxBulkErrors = 1000
+	bulkManifest  = "manifest.json"
+	bulkPrefix    = "bulk"
+)
+
+// A document in a bulk payload of newline-delimited JSON. In the manifest of
+// a tar archive the text may instead be read from the named file in the archive.
+type BulkRecord struct {
+	Doctype uint32                 `json:"doctype"`
+	Docid   uint32                 `json:"docid"`
+	Title   string                 `json:"title"`
+	Text    string                 `json:"text"`
+	File    string                 `json:"file,omitempty"`
+	Meta    map[string]interface{} `json:"meta"`
+	number  int
+}
+
+// Records are numbered from 1 in the order they appear in the payload or manifest
+type BulkError struct {
+	Record  int                  `json:"record"`
+	Id      *document.DocumentID `json:"id,omitempty"`
+	Message string               `bson:"error" json:"error"`
+}
+
+type bulkReader interface {
+	// Returns io.EOF after the last record. A *BulkError only affects one
+	// record and reading can continue.
+	Next() (*BulkRecord, error)
+	Total() int
+}
+
+type ndjsonReader struct {
+	r     *bufio.Reader
+	line  int
+	total int
+}
+
+type tarReader struct {
+	tr      *tar.Reader
+	pending map[string]*BulkRecord
+	ready   []error
+	records []*BulkRecord
+	total   int
+	done    bool
+}
+
+func (e *BulkError) Error() string {
+	return e.Message
+}
+
+func newBulkError(record *BulkRecord, err error) *BulkError {
+	e := &BulkError{Record: record.number, Message: err.Error()}
+	if record.Doctype != 0 || record.Docid != 0 {
+		e.Id = &document.DocumentID{Doctype: record.Doctype, Docid: record.Docid}
+	}
+	return e
+}
+
+// Meta values are stored as lists of strings, as they are for form payloads
+func bulkMeta(meta map[string]interface{}) document.MetaMap {
+	m := make(document.MetaMap)
+	for k, v := range meta {
+		switch v := v.(type) {
+		case string:
+			m[k] = []string{v}
+		case []interface{}:
+			values := make([]string, len(v))
+			for i := range v {
+				values[i] = fmt.Sprint(v[i])
+			}
+			m[k] = values
+		default:
+			m[k] = []string{fmt.Sprint(v)}
+		}
+	}
+	return m
+}
+
+func (r *BulkRecord) document() (*document.Document, error) {
+	if r.Doctype == 0 || r.Docid == 0 {
+		return nil, errors.New("Bad doctype or docid")
+	}
+	if len(r.Title) == 0 || len(r.Text) == 0 {
+		return nil, errors.New("Missing title or text fields")
+	}
+	return document.BuildDocument(r.Doctype, r.Docid, r.Title, r.Text, bulkMeta(r.Meta))
+}
+
+func (n *ndjsonReader) Next() (*BulkRecord, error) {
+	for {
+		b, err := n.r.ReadBytes('\n')
+		if len(bytes.TrimSpace(b)) == 0 {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		n.line++
+		record := &BulkRecord{number: n.line}
+		if err := json.Unmarshal(b, record); err != nil {
+			return nil, newBulkError(record, err)
+		}
+		return record, nil
+	}
+}
+
+func (n *ndjsonReader) Total() int {
+	return n.total
+}
+
+// Counts the records in a payload without parsing them
+func countRecords(r io.Reader) (int, error) {
+	count, br := 0, bufio.NewReader(r)
+	for {
+		b, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(b)) > 0 {
+			count++
+		}
+		switch {
+		case err == io.EOF:
+			return count, nil
+		case err != nil:
+			return count, err
+		}
+	}
+}
+
+// The manifest must be the first file in the archive
+func newTarReader(r io.Reader) (*tarReader, error) {
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if path.Clean(header.Name) != bulkManifest {
+		return nil, fmt.Errorf("The first file in the archive must be %s", bulkManifest)
+	}
+	t := &tarReader{tr: tr, pending: make(map[string]*BulkRecord)}
+	manifest := &ndjsonReader{r: bufio.NewReader(tr)}
+	for {
+		record, err := manifest.Next()
+		switch err.(type) {
+		case nil:
+		case *BulkError:
+			t.ready = append(t.ready, err)
+			continue
+		default:
+			if err == io.EOF {
+				t.total = manifest.line
+				return t, nil
+			}
+			return nil, err
+		}
+		switch file := path.Clean(record.File); {
+		case record.File == "":
+			t.records = append(t.records, record)
+		case t.pending[file] != nil:
+			t.ready = append(t.ready, newBulkError(record, fmt.Errorf("File %s is listed more than once", record.File)))
+		default:
+			t.pending[file] = record
+		}
+	}
+}
+
+// Records with their text in the manifest come first, followed by those with
+// files in the order the files appear in the archive.
+func (t *tarReader) Next() (*BulkRecord, error) {
+	for {
+		switch {
+		case len(t.ready) > 0:
+			err := t.ready[0]
+			t.ready = t.ready[1:]
+			return nil, err
+		case len(t.records) > 0:
+			record := t.records[0]
+			t.records = t.records[1:]
+			return record, nil
+		case t.done:
+			return nil, io.EOF
+		}
+		header, err := t.tr.Next()
+		if err == io.EOF {
+			t.done = true
+			t.missing()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		name := path.Clean(header.Name)
+		record, ok := t.pending[name]
+		if !ok {
+			t.ready = append(t.ready, &BulkError{Message: fmt.Sprintf("File %s is not in the manifest", header.Name)})
+			continue
+		}
+		delete(t.pending, name)
+		text, err := ioutil.ReadAll(t.tr)
+		if err != nil {
+			return nil, err
+		}
+		record.Text = string(text)
+		return record, nil
+	}
+}
+
+func (t *tarReader) missing() {
+	records := make([]*BulkRecord, 0, len(t.pending))
+	for _, record := range t.pending {
+		records = append(records, record)
+	}
+	sort.Sort(bulkRecordSlice(records))
+	for _, record := range records {
+		t.ready = append(t.ready, newBulkError(record, fmt.Errorf("File %s is missing from the archive", record.File)))
+	}
+}
+
+func (t *tarReader) Total() int {
+	return t.total
+}
+
+type bulkRecordSlice []*BulkRecord
+
+func (s bulkRecordSlice) Len() int           { return len(s) }
+func (s bulkRecordSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bulkRecordSlice) Less(i, j int) bool { return s[i].number < s[j].number }
+
+type bulkFile struct {
+	*gzip.Reader
+	file *mgo.GridFile
+}
+
+func (f *bulkFile) Close() error {
+	f.Reader.Close()
+	return f.file.Close()
+}
+
+func openBulkFile(db *mgo.Database, id bson.ObjectId) (*bulkFile, error) {
+	file, err := db.GridFS(bulkPrefix).OpenId(id)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &bulkFile{gz, file}, nil
+}
+
+// Tar archives are recognised by the magic in their first header,
+// anything else is read as newline-delimited JSON.
+func isTar(b []byte) bool {
+	return len(b) >= 262 && string(b[257:262]) == "ustar"
+}
+
+func newBulkReader(db *mgo.Database, id bson.ObjectId) (bulkReader, io.Closer, error) {
+	f, err := openBulkFile(db, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReaderSize(f, 4096)
+	if magic, _ := r.Peek(262); isTar(magic) {
+		t, err := newTarReader(r)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return t, f, nil
+	}
+	counter, err := openBulkFile(db, id)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	defer counter.Close()
+	total, err := countRecords(counter)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &ndjsonReader{r: r, total: total}, f, nil
+}
+
+// Stores the payload in GridFS, as it may be larger than a queue item can hold
+func NewBulkItem(registry *registry.Registry, priority Priority, payload io.Reader) (*QueueItem, error) {
+	db := registry.DB()
+	defer db.Session.Close()
+	file, err := db.GridFS(bulkPrefix).Create("")
+	if err != nil {
+		return nil, newQueueError("Bulk Item create:", err)
+	}
+	w, _ := gzip.NewWriterLevel(file, gzip.BestSpeed)
+	if _, err := io.Copy(w, payload); err != nil {
+		file.Abort()
+		file.Close()
+		return nil, newQueueError("Bulk Item copy:", err)
+	}
+	if err := w.Close(); err != nil {
+		file.Abort()
+		file.Close()
+		return nil, newQueueError("Bulk Item gzip close:", err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, newQueueError("Bulk Item close:", err)
+	}
+	id := file.Id().(bson.ObjectId)
+	return NewQueueItem(registry, "Bulk Add", priority, nil, nil, "", "", strings.NewReader(id.Hex()))
+}
+
+func (q *QueueItem) bulkFile() (bson.ObjectId, error) {
+	id, err := q.getPayload()
+	if err != nil {
+		return "", err
+	}
+	if !bson.IsObjectIdHex(id) {
+		return "", errors.New("Bad bulk file id")
+	}
+	return bson.ObjectIdHex(id), nil
+}
+
+// Removes the payloads of bulk items matching query
+func removeBulkFiles(db *mgo.Database, query bson.M) error {
+	var item QueueItem
+	iter := db.C("queue").Find(bson.M{"$and": []bson.M{query, {"command": "Bulk Add"}}}).Select(bson.M{"payload": 1}).Iter()
+	for iter.Next(&item) {
+		id, err := item.bulkFile()
+		if err != nil {
+			continue
+		}
+		if err := db.GridFS(bulkPrefix).RemoveId(id); err != nil && err != mgo.ErrNotFound {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// Saves a batch of documents with distinct ids. The previous text of changed
+// documents is recorded on the item before any is saved, so that a retry of a
+// failed batch still removes their old hashes. New and unchanged documents are
+// added together, which is a no-op on the posting servers for any already
+// indexed by an earlier attempt.
+func (q *QueueItem) addBatch(registry *registry.Registry, client *posting.Client, docs []*document.Document) error {
+	ids := make([]document.DocumentID, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.Id
+	}
+	existing, err := document.GetDocumentBatch(ids, registry)
+	if err != nil {
+		return err
+	}
+	previous := make(map[document.DocumentID]*document.Document)
+	for _, doc := range existing {
+		previous[doc.Id] = doc
+	}
+	pending := make(map[document.DocumentID]string)
+	for _, p := range q.Pending {
+		pending[p.Id] = p.Text
+	}
+	inserts, adds := make([]*document.Document, 0, len(docs)), make([]document.DocumentID, 0, len(docs))
+	saves, updates := make([]*document.Document, 0, len(docs)), make([]previousText, 0)
+	for _, doc := range docs {
+		prev, ok := previous[doc.Id]
+		if !ok {
+			inserts = append(inserts, doc)
+			adds = append(adds, doc.Id)
+			continue
+		}
+		saves = append(saves, doc)
+		text, retried := pending[doc.Id]
+		if !retried {
+			text = prev.Text
+		}
+		delete(pending, doc.Id)
+		if text == doc.Text {
+			adds = append(adds, doc.Id)
+		} else {
+			updates = append(updates, previousText{Id: doc.Id, Exists: true, Text: text})
+		}
+	}
+	rest := make([]previousText, 0, len(pending))
+	for id, text := range pending {
+		rest = append(rest, previousText{Id: id, Exists: true, Text: text})
+	}
+	if len(updates) > 0 {
+		if err := q.savePending(registry, append(rest, updates...)); err != nil {
+			return err
+		}
+	}
+	for _, doc := range saves {
+		if err := doc.Save(registry); err != nil {
+			return err
+		}
+	}
+	for i := range updates {
+		update := &document.UpdateArg{DocumentArg: document.DocumentArg{Id: &updates[i].Id}, Previous: updates[i].Text}
+		if err := client.CallMultiple("Posting.Update", update); err != nil {
+			return err
+		}
+	}
+	if len(inserts) > 0 {
+		if err := document.InsertDocuments(registry, inserts); err != nil {
+			return err
+		}
+	}
+	if len(adds) > 0 {
+		if err := client.CallMultiple("Posting.AddMultiple", &document.DocumentsArg{Ids: adds}); err != nil {
+			return err
+		}
+	}
+	if len(updates) > 0 {
+		if err := q.savePending(registry, rest); err != nil {
+			return err
+		}
+	}
+	return queueClustering(registry, ids...)
+}
+
+func (q *QueueItem) savePending(registry *registry.Registry, pending []previousText) error {
+	change := bson.M{"$set": bson.M{"pending": pending}}
+	if len(pending) == 0 {
+		change = bson.M{"$unset": bson.M{"pending": 1}}
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	if err := db.C("queue").UpdateId(q.Id, change); err != nil {
+		return err
+	}
+	q.Pending = pending
+	return nil
+}
+
+func (q *QueueItem) bulkError(e *BulkError) {
+	if len(q.Errors) < maxBulkErrors {
+		q.Errors = append(q.Errors, *e)
+	}
+}
+
+// Documents which can't be read or built are listed in the item's errors
+// and the rest are still added. Failures to save or index a batch fail the item.
+func BulkAdd(item *QueueItem, registry *registry.Registry, client *posting.Client, c chan *QueueItemRun) {
+	id, err := item.bulkFile()
+	if err != nil {
+		c <- runFailure(item, "Get Payload", err)
+		return
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	reader, closer, err := newBulkReader(db, id)
+	if err != nil {
+		c <- runFailure(item, "Open Payload", err)
+		return
+	}
+	defer closer.Close()
+	item.Errors = nil
+	batch, batched := make([]*document.Document, 0, bulkBatchSize), make(map[document.DocumentID]bool)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := item.addBatch(registry, client, batch)
+		batch, batched = batch[:0], make(map[document.DocumentID]bool)
+		return err
+	}
+	processed, failed := 0, 0
+	for {
+		if item.Cancelled(registry) {
+			c <- runCancelled(item)
+			return
+		}
+		record, err := reader.Next()
+		if e, ok := err.(*BulkError); ok {
+			item.bulkError(e)
+			processed++
+			failed++
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c <- runFailure(item, "Read Payload", err)
+			return
+		}
+		processed++
+		doc, err := record.document()
+		if err != nil {
+			item.bulkError(newBulkError(record, err))
+			failed++
+			continue
+		}
+		if batched[doc.Id] {
+			if err := flush(); err != nil {
+				c <- runFailure(item, "Add Batch", err)
+				return
+			}
+		}
+		batch, batched[doc.Id] = append(batch, doc), true
+		if len(batch) == bulkBatchSize {
+			if err := flush(); err != nil {
+				c <- runFailure(item, "Add Batch", err)
+				return
+			}
+		}
+		item.Report(registry, processed, reader.Total(), doc.Id.String())
+	}
+	if err := flush(); err != nil {
+		c <- runFailure(item, "Add Batch", err)
+		return
+	}
+	item.Report(registry, processed, reader.Total(), "")
+	if failed > 0 {
+		item.Error = fmt.Sprintf("%d of %d documents failed", failed, processed)
+	}
+	if err := db.GridFS(bulkPrefix).RemoveId(id); err != nil {
+		c <- runFailure(item, "Remove Payload", err)
+		return
+	}
+	c <- runSuccess(item)
+}
@@ -0,0 +1,108 @@
+package queue
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"io"
+	. "launchpad.net/gocheck"
+	"strings"
+)
+
+type BulkSuite struct{}
+
+var _ = Suite(&BulkSuite{})
+
+func readAll(r bulkReader) ([]*BulkRecord, []*BulkError, error) {
+	var records []*BulkRecord
+	var errors []*BulkError
+	for {
+		record, err := r.Next()
+		switch e := err.(type) {
+		case nil:
+			records = append(records, record)
+		case *BulkError:
+			errors = append(errors, e)
+		default:
+			if err == io.EOF {
+				return records, errors, nil
+			}
+			return records, errors, err
+		}
+	}
+}
+
+func buildTar(files ...string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	for i := 0; i < len(files); i += 2 {
+		w.WriteHeader(&tar.Header{Name: files[i], Mode: 0644, Size: int64(len(files[i+1]))})
+		w.Write([]byte(files[i+1]))
+	}
+	w.Close()
+	return buf
+}
+
+func (s *BulkSuite) TestRecord(c *C) {
+	record := &BulkRecord{Doctype: 1, Docid: 2, Title: "Title", Text: "Some text", Meta: map[string]interface{}{
+		"year":    2013.0,
+		"authors": []interface{}{"A", "B"},
+		"source":  "web",
+	}}
+	doc, err := record.document()
+	c.Assert(err, IsNil)
+	c.Check(doc.Id.String(), Equals, "(1,2)")
+	c.Check(doc.Meta["year"], DeepEquals, []string{"2013"})
+	c.Check(doc.Meta["authors"], DeepEquals, []string{"A", "B"})
+	c.Check(doc.Meta["source"], DeepEquals, []string{"web"})
+	record.Text = ""
+	_, err = record.document()
+	c.Check(err, ErrorMatches, "Missing title or text fields")
+	record.Docid = 0
+	_, err = record.document()
+	c.Check(err, ErrorMatches, "Bad doctype or docid")
+}
+
+func (s *BulkSuite) TestNDJSON(c *C) {
+	payload := `{"doctype":1,"docid":1,"title":"One","text":"First"}
+
+{"doctype":1,"docid":2,
+{"doctype":1,"docid":3,"title":"Three","text":"Third"}`
+	total, err := countRecords(strings.NewReader(payload))
+	c.Check(err, IsNil)
+	c.Check(total, Equals, 3)
+	r := &ndjsonReader{r: bufio.NewReader(strings.NewReader(payload)), total: total}
+	records, errors, err := readAll(r)
+	c.Check(err, IsNil)
+	c.Assert(records, HasLen, 2)
+	c.Check(records[0].Title, Equals, "One")
+	c.Check(records[1].number, Equals, 3)
+	c.Assert(errors, HasLen, 1)
+	c.Check(errors[0].Record, Equals, 2)
+	c.Check(errors[0].Id, IsNil)
+	c.Check(isTar([]byte(payload)), Equals, false)
+}
+
+func (s *BulkSuite) TestTar(c *C) {
+	manifest := `{"doctype":1,"docid":1,"title":"One","file":"docs/one.txt"}
+{"doctype":1,"docid":2,"title":"Two","text":"Inline"}
+{"doctype":1,"docid":3,"title":"Three","file":"docs/three.txt"}
+`
+	payload := buildTar("manifest.json", manifest, "docs/one.txt", "First", "docs/extra.txt", "Extra")
+	c.Check(isTar(payload.Bytes()), Equals, true)
+	r, err := newTarReader(payload)
+	c.Assert(err, IsNil)
+	c.Check(r.Total(), Equals, 3)
+	records, errors, err := readAll(r)
+	c.Check(err, IsNil)
+	c.Assert(records, HasLen, 2)
+	c.Check(records[0].Text, Equals, "Inline")
+	c.Check(records[1].Text, Equals, "First")
+	c.Assert(errors, HasLen, 2)
+	c.Check(errors[0].Message, Equals, "File docs/extra.txt is not in the manifest")
+	c.Check(errors[1].Record, Equals, 3)
+	c.Check(errors[1].Id.String(), Equals, "(1,3)")
+
+	_, err = newTarReader(buildTar("docs/one.txt", "First", "manifest.json", manifest))
+	c.Check(err, ErrorMatches, "The first file in the archive must be manifest.json")
+}
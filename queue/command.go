@@ -7,80 +7,202 @@ import (
 	"github.com/donovanhide/superfastmatch/posting"
 	"github.com/donovanhide/superfastmatch/registry"
 	"github.com/golang/glog"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"strconv"
+	"strings"
 )
 
+// The number of documents sent to the posting servers at once
+const batchSize = 100
+
 type QueueItemRun struct {
-	item *QueueItem
-	err  error
+	item  *QueueItem
+	err   error
+	retry bool
 }
 
 type commandFunc func(item *QueueItem, registry *registry.Registry, client *posting.Client, c chan *QueueItemRun)
 
 var commandMap = map[string]commandFunc{
 	"Add Document":       AddDocument,
+	"Update Document":    UpdateDocument,
 	"Delete Document":    DeleteDocument,
+	"Delete Documents":   DeleteDocuments,
 	"Associate Document": AssociateDocument,
 	"Test Corpus":        TestCorpus,
+	"Find Repeats":       FindRepeats,
+	"Cluster Documents":  ClusterDocuments,
+	"Bulk Add":           BulkAdd,
+	"Reindex":            Reindex,
+	"Fill Signatures":    FillSignatures,
 }
 
 func runFailure(item *QueueItem, s string, err error) *QueueItemRun {
-	return &QueueItemRun{item, errors.New(fmt.Sprintf("%s: %s", s, err))}
+	return &QueueItemRun{item, errors.New(fmt.Sprintf("%s: %s", s, err)), retryable(err)}
 }
 
 func runSuccess(item *QueueItem) *QueueItemRun {
-	return &QueueItemRun{item, nil}
+	return &QueueItemRun{item, nil, false}
 }
 
-func (items QueueItemSlice) Execute(registry *registry.Registry, client *posting.Client) error {
-	c := make(chan *QueueItemRun, len(items))
-	for i := range items {
-		item := &items[i]
-		f, ok := commandMap[item.Command]
-		if !ok {
-			return errors.New("Command does not exist!")
-		}
-		if err := item.UpdateStatus(registry, "Started"); err != nil {
-			return err
-		}
-		go f(item, registry, client, c)
+func AddDocument(item *QueueItem, registry *registry.Registry, client *posting.Client, c chan *QueueItemRun) {
+	c <- addDocument(item, registry, client, false)
+}
+
+func UpdateDocument(item *QueueItem, registry *registry.Registry, client *posting.Client, c chan *QueueItemRun) {
+	c <- addDocument(item, registry, client, true)
+}
+
+// The text of a document before the item first changed it
+type previousText struct {
+	Id     document.DocumentID `bson:"id"`
+	Exists bool                `bson:"exists"`
+	Text   string              `bson:"text,omitempty"`
+}
+
+// Recorded on the first attempt, before the new text is saved, so that a retry
+// applies the same difference to the posting servers as the failed attempt.
+func (q *QueueItem) previousText(registry *registry.Registry) (*previousText, error) {
+	if q.Previous != nil {
+		return q.Previous, nil
 	}
-	for i := 0; i < len(items); i++ {
-		run := <-c
-		if run.err != nil {
-			run.item.Status = "Failed"
-			run.item.Error = run.err.Error()
-			glog.Errorf("Failed Queue Item: %v Error: %s", run.item, run.err)
-		} else {
-			run.item.Status = "Completed"
-			run.item.Payload = []byte(nil)
-		}
-		if err := run.item.Save(registry); err != nil {
-			return err
-		}
+	previous := &previousText{Id: *q.Target}
+	switch doc, err := document.GetDocument(q.Target, registry); {
+	case err == mgo.ErrNotFound:
+	case err != nil:
+		return nil, err
+	default:
+		previous.Exists, previous.Text = true, doc.Text
 	}
-	return nil
+	db := registry.DB()
+	defer db.Session.Close()
+	if err := db.C("queue").UpdateId(q.Id, bson.M{"$set": bson.M{"previous": previous}}); err != nil {
+		return nil, err
+	}
+	q.Previous = previous
+	return previous, nil
 }
 
-func AddDocument(item *QueueItem, registry *registry.Registry, client *posting.Client, c chan *QueueItemRun) {
+// If the document already exists only the difference between the previous
+// and new text is applied to the posting servers.
+func addDocument(item *QueueItem, registry *registry.Registry, client *posting.Client, mustExist bool) *QueueItemRun {
 	values, err := item.PayloadValues()
 	if err != nil {
-		c <- runFailure(item, "Get Payload", err)
-		return
+		return runFailure(item, "Get Payload", err)
 	}
+	duplicates, threshold := values.Get("duplicates"), document.NewDuplicateThreshold(values.Get("duplicate_threshold"))
+	values.Del("duplicates")
+	values.Del("duplicate_threshold")
 	doc, err := document.NewDocument(item.Target, values)
 	if err != nil {
-		c <- runFailure(item, "New Document", err)
-		return
+		return runFailure(item, "New Document", err)
+	}
+	if duplicates != "" {
+		if err := checkDuplicates(registry, doc, duplicates, threshold); err != nil {
+			return runFailure(item, "Duplicate Check", err)
+		}
+	}
+	previous, err := item.previousText(registry)
+	switch {
+	case err != nil:
+		return runFailure(item, "Get Previous Document", err)
+	case !previous.Exists && mustExist:
+		return runFailure(item, "Get Previous Document", mgo.ErrNotFound)
 	}
 	if err = doc.Save(registry); err != nil {
-		c <- runFailure(item, "Save Document", err)
-		return
+		return runFailure(item, "Save Document", err)
 	}
-	if err = client.CallMultiple("Posting.Add", &document.DocumentArg{Id: &doc.Id}); err != nil {
-		c <- runFailure(item, "RPC Call", err)
-		return
+	if !previous.Exists {
+		err = client.CallMultiple("Posting.Add", &document.DocumentArg{Id: &doc.Id})
+	} else {
+		err = client.CallMultiple("Posting.Update", &document.UpdateArg{DocumentArg: document.DocumentArg{Id: &doc.Id}, Previous: previous.Text})
 	}
-	c <- runSuccess(item)
+	if err != nil {
+		return runFailure(item, "RPC Call", err)
+	}
+	if err = queueClustering(registry, doc.Id); err != nil {
+		return runFailure(item, "Cluster Document", err)
+	}
+	return runSuccess(item)
+}
+
+// Near duplicates either fail the item or are listed in the meta data of the new document
+func checkDuplicates(registry *registry.Registry, doc *document.Document, option string, threshold float64) error {
+	result, err := document.FindDuplicates(registry, doc, threshold)
+	switch {
+	case err != nil:
+		return err
+	case option != "reject" && option != "tag":
+		return fmt.Errorf("Unknown duplicates option: %s", option)
+	case result.TotalRows == 0:
+		return nil
+	case option == "reject":
+		d := result.Rows[0]
+		return fmt.Errorf("%d near duplicates including %v with similarity %.2f", result.TotalRows, d.Id.String(), d.Similarity)
+	}
+	ids := make([]string, len(result.Rows))
+	for i, d := range result.Rows {
+		ids[i] = fmt.Sprintf("%d/%d", d.Id.Doctype, d.Id.Docid)
+	}
+	doc.Meta["duplicate_of"] = ids
+	return nil
+}
+
+func associate(registry *registry.Registry, client *posting.Client, id *document.DocumentID, targetRange string) (document.AssociationSlice, error) {
+	doc := &document.DocumentArg{Id: id, TargetRange: targetRange, Limit: 10}
+	group, err := client.Search(doc)
+	if err != nil {
+		return nil, err
+	}
+	result, err := group.GetResult(registry, doc, true)
+	if err != nil {
+		return nil, err
+	}
+	return result.Associations, nil
+}
+
+// Clusters are changed by one Cluster Documents item at a time, so new
+// documents which fall in the range of a clustering are added by queueing one
+func queueClustering(registry *registry.Registry, ids ...document.DocumentID) error {
+	clusterings, err := document.GetClusterings(registry)
+	if err != nil {
+		return err
+	}
+	for i := range clusterings {
+		for j := range ids {
+			if clusterings[i].Contains(ids[j]) {
+				targetRange := string(document.DocumentIDSlice(ids).Range())
+				_, err := NewQueueItem(registry, "Cluster Documents", DefaultPriority, nil, nil, "", targetRange, strings.NewReader(""))
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Updates the membership of any clusters whose range includes the new documents
+func clusterDocuments(registry *registry.Registry, client *posting.Client, ids ...document.DocumentID) error {
+	clusterings, err := document.GetClusterings(registry)
+	if err != nil {
+		return err
+	}
+	for i := range clusterings {
+		clustering := &clusterings[i]
+		for j := range ids {
+			if !clustering.Contains(ids[j]) {
+				continue
+			}
+			associations, err := associate(registry, client, &ids[j], string(clustering.Range))
+			if err != nil {
+				return err
+			}
+			if err := clustering.Add(registry, ids[j], associations); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func DeleteDocument(item *QueueItem, registry *registry.Registry, client *posting.Client, c chan *QueueItemRun) {
@@ -100,6 +222,96 @@ func DeleteDocument(item *QueueItem, registry *registry.Registry, client *postin
 	c <- runSuccess(item)
 }
 
+// Documents are removed from the posting servers before Mongo, which the
+// posting servers read them from, so a retry picks up where a failure left off.
+func DeleteDocuments(item *QueueItem, registry *registry.Registry, client *posting.Client, c chan *QueueItemRun) {
+	ids, err := document.GetDocids(item.SourceRange, registry)
+	if err != nil {
+		c <- runFailure(item, "Get Source Range", err)
+		return
+	}
+	for i, batch := range batchIds(ids) {
+		if item.Cancelled(registry) {
+			c <- runCancelled(item)
+			return
+		}
+		item.Report(registry, i*batchSize, len(ids), batch[0].String())
+		if err := client.CallMultiple("Posting.DeleteMultiple", &document.DocumentsArg{Ids: batch}); err != nil {
+			c <- runFailure(item, "RPC Call", err)
+			return
+		}
+		if _, err := document.DeleteDocuments(registry, batch); err != nil {
+			c <- runFailure(item, "Delete Documents", err)
+			return
+		}
+	}
+	item.Report(registry, len(ids), len(ids), "")
+	c <- runSuccess(item)
+}
+
+// Rebuilds the posting servers from the documents stored in the source range,
+// or from every document if there is none. With shadow=true in the payload
+// searches keep working during the rebuild, otherwise the documents in the
+// range are missing from them until it ends, or until the next reindex if it
+// is cancelled.
+func Reindex(item *QueueItem, registry *registry.Registry, client *posting.Client, c chan *QueueItemRun) {
+	values, err := item.PayloadValues()
+	if err != nil {
+		c <- runFailure(item, "Get Payload", err)
+		return
+	}
+	shadow, _ := strconv.ParseBool(values.Get("shadow"))
+	ids, err := document.GetDocids(item.SourceRange, registry)
+	if err != nil {
+		c <- runFailure(item, "Get Source Range", err)
+		return
+	}
+	arg := &posting.ReindexArg{Id: item.Id.Hex(), Range: document.DocTypeRange(item.SourceRange), Shadow: shadow}
+	abort := func() {
+		if err := client.CallMultiple("Posting.AbortReindex", arg); err != nil {
+			glog.Errorf("Abort Reindex: %v Error: %s", item, err)
+		}
+	}
+	if err := client.CallMultiple("Posting.BeginReindex", arg); err != nil {
+		abort()
+		c <- runFailure(item, "Begin Reindex", err)
+		return
+	}
+	for i, batch := range batchIds(ids) {
+		if item.Cancelled(registry) {
+			abort()
+			c <- runCancelled(item)
+			return
+		}
+		item.Report(registry, i*batchSize, len(ids), batch[0].String())
+		if err := client.CallMultiple("Posting.Reindex", &posting.ReindexDocumentsArg{DocumentsArg: document.DocumentsArg{Ids: batch}, Id: arg.Id}); err != nil {
+			abort()
+			c <- runFailure(item, "Reindex", err)
+			return
+		}
+	}
+	if err := client.CallMultiple("Posting.EndReindex", arg); err != nil {
+		abort()
+		c <- runFailure(item, "End Reindex", err)
+		return
+	}
+	item.Report(registry, len(ids), len(ids), "")
+	c <- runSuccess(item)
+}
+
+// Splits ids into consecutive batches of at most batchSize
+func batchIds(ids []document.DocumentID) [][]document.DocumentID {
+	batches := make([][]document.DocumentID, 0, len(ids)/batchSize+1)
+	for len(ids) > batchSize {
+		batches = append(batches, ids[:batchSize])
+		ids = ids[batchSize:]
+	}
+	if len(ids) > 0 {
+		batches = append(batches, ids)
+	}
+	return batches
+}
+
 func AssociateDocument(item *QueueItem, registry *registry.Registry, client *posting.Client, c chan *QueueItemRun) {
 	var err error
 	var source []document.DocumentID
@@ -109,25 +321,116 @@ func AssociateDocument(item *QueueItem, registry *registry.Registry, client *pos
 	if item.SourceRange != "" {
 		if source, err = document.GetDocids(item.SourceRange, registry); err != nil {
 			c <- runFailure(item, "Get Source Range", err)
+			return
 		}
 	}
-	fmt.Println(source, item.Target, item.TargetRange)
-	for _, s := range source {
-		doc := &document.DocumentArg{Id: &s, TargetRange: item.TargetRange}
+	values, err := item.PayloadValues()
+	if err != nil {
+		c <- runFailure(item, "Get Payload", err)
+		return
+	}
+	for i := range source {
+		if item.Cancelled(registry) {
+			c <- runCancelled(item)
+			return
+		}
+		item.Report(registry, i, len(source), source[i].String())
+		doc := &document.DocumentArg{Id: &source[i], TargetRange: item.TargetRange, Limit: 10, Index: values.Get("index"), Exclusions: document.NewExclusions(*values)}
 		result, err := client.Search(doc)
 		if err != nil {
 			c <- runFailure(item, "Search", err)
+			return
 		}
 		if _, err := result.GetResult(registry, doc, true); err != nil {
 			c <- runFailure(item, "Get Result", err)
+			return
+		}
+	}
+	item.Report(registry, len(source), len(source), "")
+	c <- runSuccess(item)
+}
+
+func FindRepeats(item *QueueItem, registry *registry.Registry, client *posting.Client, c chan *QueueItemRun) {
+	ids, err := document.GetDocids(item.SourceRange, registry)
+	if err != nil {
+		c <- runFailure(item, "Get Source Range", err)
+		return
+	}
+	for i := range ids {
+		if item.Cancelled(registry) {
+			c <- runCancelled(item)
+			return
+		}
+		item.Report(registry, i, len(ids), ids[i].String())
+		doc, err := document.GetDocument(&ids[i], registry)
+		if err != nil {
+			c <- runFailure(item, "Get Document", err)
+			return
+		}
+		if err := document.BuildRepeats(registry.WindowSize, doc).Save(registry); err != nil {
+			c <- runFailure(item, "Save Repeats", err)
+			return
 		}
 	}
+	item.Report(registry, len(ids), len(ids), "")
+	c <- runSuccess(item)
+}
+
+// With a target range the documents in it are added to the existing clusters,
+// otherwise the clusters for the source range are rebuilt.
+func ClusterDocuments(item *QueueItem, registry *registry.Registry, client *posting.Client, c chan *QueueItemRun) {
+	if item.TargetRange != "" {
+		ids, err := document.GetDocids(item.TargetRange, registry)
+		if err != nil {
+			c <- runFailure(item, "Get Target Range", err)
+			return
+		}
+		if err := clusterDocuments(registry, client, ids...); err != nil {
+			c <- runFailure(item, "Cluster Documents", err)
+			return
+		}
+		c <- runSuccess(item)
+		return
+	}
+	values, err := item.PayloadValues()
+	if err != nil {
+		c <- runFailure(item, "Get Payload", err)
+		return
+	}
+	ids, err := document.GetDocids(item.SourceRange, registry)
+	if err != nil {
+		c <- runFailure(item, "Get Source Range", err)
+		return
+	}
+	clustering := document.NewClustering(item.SourceRange, values)
+	set := make(document.DisjointSet)
+	for i := range ids {
+		if item.Cancelled(registry) {
+			c <- runCancelled(item)
+			return
+		}
+		item.Report(registry, i, len(ids), ids[i].String())
+		associations, err := associate(registry, client, &ids[i], item.SourceRange)
+		if err != nil {
+			c <- runFailure(item, "Associate", err)
+			return
+		}
+		clustering.Join(set, ids[i], associations)
+	}
+	item.Report(registry, len(ids), len(ids), "")
+	if err := clustering.Replace(registry, set); err != nil {
+		c <- runFailure(item, "Save Clusters", err)
+		return
+	}
 	c <- runSuccess(item)
 }
 
 func TestCorpus(item *QueueItem, registry *registry.Registry, client *posting.Client, c chan *QueueItemRun) {
-	docs := document.BuildTestCorpus(10, 20, 5000)
+	const maxDoctype, maxDocid = 10, 20
+	total, processed := maxDoctype*maxDocid, 0
+	docs := document.BuildTestCorpus(maxDoctype, maxDocid, 5000)
 	for doc := <-docs; doc != nil; doc = <-docs {
+		item.Report(registry, processed, total, doc.Id.String())
 		if err := doc.Save(registry); err != nil {
 			c <- runFailure(item, "Save Document", err)
 			return
@@ -136,6 +439,17 @@ func TestCorpus(item *QueueItem, registry *registry.Registry, client *posting.Cl
 			c <- runFailure(item, "RPC Call", err)
 			return
 		}
+		processed++
+	}
+	item.Report(registry, processed, total, "")
+	c <- runSuccess(item)
+}
+
+// Computes the signatures of documents stored before duplicate detection existed
+func FillSignatures(item *QueueItem, registry *registry.Registry, client *posting.Client, c chan *QueueItemRun) {
+	if err := document.FillSignatures(registry); err != nil {
+		c <- runFailure(item, "Fill Signatures", err)
+		return
 	}
 	c <- runSuccess(item)
 }
@@ -0,0 +1,99 @@
+package queue
+
+import (
+	"errors"
+	"github.com/donovanhide/superfastmatch/registry"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/url"
+	"time"
+)
+
+// How often a running command checks whether it has been cancelled
+const cancelInterval = time.Second
+
+var errCancelled = errors.New("Cancelled")
+
+var ErrNotCancellable = errors.New("Queue item has already finished")
+
+type QueueStateResult struct {
+	Success bool `json:"success"`
+	Paused  bool `json:"paused"`
+}
+
+func runCancelled(item *QueueItem) *QueueItemRun {
+	return &QueueItemRun{item, errCancelled, false}
+}
+
+// Long running commands call this between documents and stop if it returns true.
+// The database is checked at most once per interval.
+func (q *QueueItem) Cancelled(registry *registry.Registry) bool {
+	if q.cancelled || time.Now().Sub(q.checked) < cancelInterval {
+		return q.cancelled
+	}
+	q.checked = time.Now()
+	db := registry.DB()
+	defer db.Session.Close()
+	n, err := db.C("queue").Find(bson.M{"_id": q.Id, "cancel": true}).Count()
+	q.cancelled = err == nil && n > 0
+	return q.cancelled
+}
+
+// Queued and Dead items are cancelled at once. Started items are flagged
+// and are cancelled when their command next checks.
+func CancelQueueItem(values url.Values, registry *registry.Registry) (*QueueItem, error) {
+	id := values.Get("id")
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New("Bad queue id")
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	queue := db.C("queue")
+	item := new(QueueItem)
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"status": "Cancelled", "finished": time.Now()}, "$unset": bson.M{"retry": 1}},
+		ReturnNew: true,
+	}
+	query := bson.M{"_id": bson.ObjectIdHex(id), "status": bson.M{"$in": []string{"Queued", "Dead"}}}
+	switch _, err := queue.Find(query).Select(bson.M{"payload": 0}).Apply(change, item); {
+	case err == nil:
+		return item, nil
+	case err != mgo.ErrNotFound:
+		return nil, newQueueError("Cancel Queue Item:", err)
+	}
+	change.Update = bson.M{"$set": bson.M{"cancel": true}}
+	query["status"] = "Started"
+	switch _, err := queue.Find(query).Select(bson.M{"payload": 0}).Apply(change, item); {
+	case err == nil:
+		return item, nil
+	case err != mgo.ErrNotFound:
+		return nil, newQueueError("Cancel Queue Item:", err)
+	}
+	if _, err := getQueueItem(bson.ObjectIdHex(id), registry); err != nil {
+		return nil, err
+	}
+	return nil, ErrNotCancellable
+}
+
+// Workers stop claiming items while the queue is paused, but finish those in flight
+func SetPaused(registry *registry.Registry, paused bool) (*QueueStateResult, error) {
+	db := registry.DB()
+	defer db.Session.Close()
+	if _, err := db.C("settings").UpsertId("queue", bson.M{"$set": bson.M{"paused": paused}}); err != nil {
+		return nil, newQueueError("Queue Pause:", err)
+	}
+	return &QueueStateResult{Success: true, Paused: paused}, nil
+}
+
+func isPaused(db *mgo.Database) (bool, error) {
+	var state struct {
+		Paused bool
+	}
+	switch err := db.C("settings").FindId("queue").One(&state); {
+	case err == mgo.ErrNotFound:
+		return false, nil
+	case err != nil:
+		return false, newQueueError("Queue Paused:", err)
+	}
+	return state.Paused, nil
+}
@@ -0,0 +1,80 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Items are run in order of priority, then age
+type Priority int
+
+const (
+	DefaultPriority Priority = iota
+	Interactive
+	Bulk
+	Background
+)
+
+var priorityNames = []string{"default", "interactive", "bulk", "background"}
+
+// Changes to single documents are interactive, scans over ranges run in the background
+var commandPriorities = map[string]Priority{
+	"Add Document":       Interactive,
+	"Update Document":    Interactive,
+	"Delete Document":    Interactive,
+	"Associate Document": Background,
+	"Test Corpus":        Background,
+	"Find Repeats":       Background,
+	"Cluster Documents":  Background,
+	"Bulk Add":           Bulk,
+	"Delete Documents":   Background,
+	"Reindex":            Background,
+	"Fill Signatures":    Background,
+}
+
+// An empty string is the default priority of the command
+func ParsePriority(s string) (Priority, error) {
+	if s == "" {
+		return DefaultPriority, nil
+	}
+	for i, name := range priorityNames {
+		if name == s {
+			return Priority(i), nil
+		}
+	}
+	return DefaultPriority, fmt.Errorf("Unknown priority: %s", s)
+}
+
+func (p Priority) resolve(command string) Priority {
+	if p != DefaultPriority {
+		return p
+	}
+	if priority, ok := commandPriorities[command]; ok {
+		return priority
+	}
+	return Interactive
+}
+
+func (p Priority) String() string {
+	if p < 0 || int(p) >= len(priorityNames) {
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+func (p Priority) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *Priority) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	priority, err := ParsePriority(s)
+	if err != nil {
+		return err
+	}
+	*p = priority
+	return nil
+}
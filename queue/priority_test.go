@@ -0,0 +1,27 @@
+package queue
+
+import (
+	"encoding/json"
+	"labix.org/v2/mgo/bson"
+	. "launchpad.net/gocheck"
+)
+
+type PrioritySuite struct{}
+
+var _ = Suite(&PrioritySuite{})
+
+func (s *PrioritySuite) TestPriority(c *C) {
+	p, err := ParsePriority("bulk")
+	c.Check(err, IsNil)
+	c.Check(p, Equals, Bulk)
+	_, err = ParsePriority("urgent")
+	c.Check(err, NotNil)
+	c.Check(DefaultPriority.resolve("Add Document"), Equals, Interactive)
+	c.Check(DefaultPriority.resolve("Associate Document"), Equals, Background)
+	c.Check(Bulk.resolve("Associate Document"), Equals, Bulk)
+	b, err := json.Marshal(&QueueItem{Id: bson.NewObjectId(), Priority: Background})
+	c.Check(err, IsNil)
+	var item QueueItem
+	c.Check(json.Unmarshal(b, &item), IsNil)
+	c.Check(item.Priority, Equals, Background)
+}
@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"fmt"
+	"github.com/donovanhide/superfastmatch/registry"
+	"github.com/golang/glog"
+	"labix.org/v2/mgo/bson"
+	"time"
+)
+
+// How often a running command saves its progress
+const progressInterval = time.Second
+
+type Progress struct {
+	Processed int        `json:"processed"`
+	Total     int        `json:"total"`
+	Current   string     `json:"current,omitempty"`
+	Started   time.Time  `json:"started"`
+	ETA       *time.Time `json:"eta,omitempty"`
+}
+
+func (p *Progress) String() string {
+	s := fmt.Sprintf("%d/%d", p.Processed, p.Total)
+	if p.Current != "" {
+		s += " Current: " + p.Current
+	}
+	if p.ETA != nil {
+		s += " ETA: " + p.ETA.Format(time.Stamp)
+	}
+	return s
+}
+
+// Long running commands call this as they go, with the number of items
+// processed so far out of the total and the item being processed. The ETA
+// assumes the remaining items take as long as those already processed.
+func (q *QueueItem) Report(registry *registry.Registry, processed int, total int, current string) {
+	now := time.Now()
+	if q.Progress == nil {
+		q.Progress = &Progress{Started: now}
+	}
+	p := q.Progress
+	p.Processed, p.Total, p.Current = processed, total, current
+	if processed > 0 && total >= processed {
+		remaining := now.Sub(p.Started) / time.Duration(processed) * time.Duration(total-processed)
+		eta := now.Add(remaining)
+		p.ETA = &eta
+	}
+	if now.Sub(q.reported) < progressInterval && processed < total {
+		return
+	}
+	q.reported = now
+	db := registry.DB()
+	defer db.Session.Close()
+	if err := db.C("queue").UpdateId(q.Id, bson.M{"$set": bson.M{"progress": p}}); err != nil {
+		glog.Errorf("Queue Item Progress: %v Error: %s", q, err)
+	}
+}
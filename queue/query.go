@@ -0,0 +1,172 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"github.com/donovanhide/superfastmatch/document"
+	"github.com/donovanhide/superfastmatch/registry"
+	"github.com/gorilla/schema"
+	"labix.org/v2/mgo/bson"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultQueueLimit = 100
+	maxQueueLimit     = 1000
+)
+
+var decoder = schema.NewDecoder()
+
+// Items are listed oldest first. The cursor of a result is passed back to
+// fetch the next page. Since and until are RFC 3339 times compared with when
+// an item was queued.
+type QueueQueryParams struct {
+	Status   []string `schema:"status"`
+	Command  []string `schema:"command"`
+	Doctypes string   `schema:"doctypes"`
+	Since    string   `schema:"since"`
+	Until    string   `schema:"until"`
+	Cursor   string   `schema:"cursor"`
+	Limit    int      `schema:"limit"`
+}
+
+type QueueResult struct {
+	Success   bool           `json:"success"`
+	Paused    bool           `json:"paused"`
+	Rows      QueueItemSlice `json:"rows"`
+	TotalRows int            `json:"totalRows"`
+	Cursor    string         `json:"cursor,omitempty"`
+}
+
+func parseTime(name string, value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("Bad %s time: %s", name, value)
+	}
+	return t, nil
+}
+
+// Returns the filter for every matching item, without the cursor
+func (q *QueueQueryParams) filter() (bson.M, error) {
+	filter := bson.M{}
+	if len(q.Status) > 0 {
+		filter["status"] = bson.M{"$in": q.Status}
+	}
+	if len(q.Command) > 0 {
+		filter["command"] = bson.M{"$in": q.Command}
+	}
+	if q.Doctypes != "" {
+		doctypes := document.DocTypeRange(q.Doctypes)
+		if !doctypes.Valid() {
+			return nil, errors.New("Bad doctypes")
+		}
+		filter["$or"] = doctypes.ParseField("target.doctype")["$or"]
+	}
+	queued := bson.M{}
+	if q.Since != "" {
+		since, err := parseTime("since", q.Since)
+		if err != nil {
+			return nil, err
+		}
+		queued["$gte"] = bson.NewObjectIdWithTime(since)
+	}
+	if q.Until != "" {
+		until, err := parseTime("until", q.Until)
+		if err != nil {
+			return nil, err
+		}
+		queued["$lt"] = bson.NewObjectIdWithTime(until)
+	}
+	if len(queued) > 0 {
+		filter["_id"] = queued
+	}
+	return filter, nil
+}
+
+// Any error is in the values, rather than in listing the queue
+func NewQueueQuery(values url.Values) (*QueueQueryParams, error) {
+	q := &QueueQueryParams{Limit: defaultQueueLimit}
+	if err := decoder.Decode(q, values); err != nil {
+		return nil, err
+	}
+	if q.Limit <= 0 || q.Limit > maxQueueLimit {
+		q.Limit = defaultQueueLimit
+	}
+	if q.Cursor != "" && !bson.IsObjectIdHex(q.Cursor) {
+		return nil, errors.New("Bad cursor")
+	}
+	if _, err := q.filter(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *QueueQueryParams) GetQueue(registry *registry.Registry) (*QueueResult, error) {
+	filter, err := q.filter()
+	if err != nil {
+		return nil, err
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	queue := db.C("queue")
+	r := &QueueResult{Success: true, Rows: make(QueueItemSlice, 0)}
+	if r.TotalRows, err = queue.Find(filter).Count(); err != nil {
+		return nil, newQueueError("Queue Count:", err)
+	}
+	if q.Cursor != "" {
+		filter = bson.M{"$and": []bson.M{filter, {"_id": bson.M{"$gt": bson.ObjectIdHex(q.Cursor)}}}}
+	}
+	if err := queue.Find(filter).Select(bson.M{"payload": 0}).Sort("_id").Limit(q.Limit).All(&r.Rows); err != nil {
+		return nil, newQueueError("Queue List:", err)
+	}
+	if len(r.Rows) == q.Limit {
+		r.Cursor = r.Rows[len(r.Rows)-1].Id.Hex()
+	}
+	if r.Paused, err = isPaused(db); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Marks a Failed, Dead or Cancelled item as seen, so that it can be purged
+func AcknowledgeQueueItem(values url.Values, registry *registry.Registry) (*QueueItem, error) {
+	id := values.Get("id")
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New("Bad queue id")
+	}
+	query := bson.M{"_id": bson.ObjectIdHex(id), "status": bson.M{"$in": []string{"Failed", "Dead", "Cancelled"}}}
+	db := registry.DB()
+	defer db.Session.Close()
+	if err := db.C("queue").Update(query, bson.M{"$set": bson.M{"acknowledged": true}}); err != nil {
+		return nil, newQueueError("Acknowledge Queue Item:", err)
+	}
+	return getQueueItem(bson.ObjectIdHex(id), registry)
+}
+
+// Removes items which completed longer ago than the retention period, along
+// with acknowledged failures. Items finished before the time was recorded are
+// aged by when they were queued. Failed items are kept until acknowledged.
+func Purge(registry *registry.Registry) (int, error) {
+	if registry.QueueRetention <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-registry.QueueRetention)
+	query := bson.M{
+		"$or": []bson.M{
+			{"status": "Completed", "finished": bson.M{"$lt": cutoff}},
+			{"status": "Completed", "finished": bson.M{"$exists": false}, "_id": bson.M{"$lt": bson.NewObjectIdWithTime(cutoff)}},
+			{"acknowledged": true},
+		},
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	if err := removeBulkFiles(db, query); err != nil {
+		return 0, newQueueError("Queue Purge:", err)
+	}
+	info, err := db.C("queue").RemoveAll(query)
+	if err != nil {
+		return 0, newQueueError("Queue Purge:", err)
+	}
+	return info.Removed, nil
+}
@@ -0,0 +1,47 @@
+package queue
+
+import (
+	"labix.org/v2/mgo/bson"
+	. "launchpad.net/gocheck"
+	"net/url"
+	"time"
+)
+
+type QueueQuerySuite struct{}
+
+var _ = Suite(&QueueQuerySuite{})
+
+func (s *QueueQuerySuite) TestFilter(c *C) {
+	q := &QueueQueryParams{
+		Status:   []string{"Failed", "Dead"},
+		Command:  []string{"Add Document"},
+		Doctypes: "1-2",
+		Since:    "2013-01-02T00:00:00Z",
+	}
+	filter, err := q.filter()
+	c.Assert(err, IsNil)
+	c.Check(filter["status"], DeepEquals, bson.M{"$in": []string{"Failed", "Dead"}})
+	c.Check(filter["command"], DeepEquals, bson.M{"$in": []string{"Add Document"}})
+	c.Check(filter["$or"], HasLen, 1)
+	since := bson.NewObjectIdWithTime(time.Date(2013, 1, 2, 0, 0, 0, 0, time.UTC))
+	c.Check(filter["_id"], DeepEquals, bson.M{"$gte": since})
+	_, err = (&QueueQueryParams{Until: "yesterday"}).filter()
+	c.Check(err, NotNil)
+	_, err = (&QueueQueryParams{Doctypes: "a-b"}).filter()
+	c.Check(err, NotNil)
+}
+
+func (s *QueueQuerySuite) TestNewQueueQuery(c *C) {
+	q, err := NewQueueQuery(url.Values{"status": {"Failed"}, "limit": {"5000"}})
+	c.Assert(err, IsNil)
+	c.Check(q.Status, DeepEquals, []string{"Failed"})
+	c.Check(q.Limit, Equals, defaultQueueLimit)
+	for _, values := range []url.Values{
+		{"limit": {"many"}},
+		{"cursor": {"nope"}},
+		{"since": {"yesterday"}},
+	} {
+		_, err := NewQueueQuery(values)
+		c.Check(err, NotNil, Commentf("%v", values))
+	}
+}
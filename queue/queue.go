@@ -7,9 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/donovanhide/superfastmatch/document"
-	"github.com/donovanhide/superfastmatch/posting"
 	"github.com/donovanhide/superfastmatch/registry"
-	"github.com/golang/glog"
 	"io"
 	"io/ioutil"
 	"labix.org/v2/mgo"
@@ -22,27 +20,36 @@ func newQueueError(s string, err error) error {
 	return errors.New(fmt.Sprint(s, err))
 }
 
-type QueueResult struct {
-	Success   bool           `json:"success"`
-	Rows      QueueItemSlice `json:"rows"`
-	TotalRows int            `json:"totalRows"`
-}
-
 type QueueItem struct {
-	Id          bson.ObjectId        `bson:"_id" json:"id"`
-	Command     string               `bson:"command" json:"command"`
-	Source      *document.DocumentID `bson:"source" json:"source"`
-	Target      *document.DocumentID `bson:"target" json:"target"`
-	SourceRange string               `bson:"sourceRange" json:"sourceRange"`
-	TargetRange string               `bson:"targetRange" json:"targetRange"`
-	Status      string               `bson:"status" json:"status"`
-	Error       string               `bson:"error" json:"error"`
-	Payload     []byte               `bson:"payload" json:"-"`
+	Id           bson.ObjectId        `bson:"_id" json:"id"`
+	Command      string               `bson:"command" json:"command"`
+	Source       *document.DocumentID `bson:"source" json:"source"`
+	Target       *document.DocumentID `bson:"target" json:"target"`
+	SourceRange  string               `bson:"sourceRange" json:"sourceRange"`
+	TargetRange  string               `bson:"targetRange" json:"targetRange"`
+	Status       string               `bson:"status" json:"status"`
+	Error        string               `bson:"error" json:"error"`
+	Priority     Priority             `bson:"priority" json:"priority"`
+	Worker       string               `bson:"worker,omitempty" json:"worker,omitempty"`
+	Lease        *time.Time           `bson:"lease,omitempty" json:"lease,omitempty"`
+	Attempts     int                  `bson:"attempts" json:"attempts"`
+	Retry        *time.Time           `bson:"retry,omitempty" json:"retry,omitempty"`
+	Cancel       bool                 `bson:"cancel,omitempty" json:"cancel,omitempty"`
+	Finished     *time.Time           `bson:"finished,omitempty" json:"finished,omitempty"`
+	Acknowledged bool                 `bson:"acknowledged,omitempty" json:"acknowledged,omitempty"`
+	Progress     *Progress            `bson:"progress,omitempty" json:"progress,omitempty"`
+	Errors       []BulkError          `bson:"errors,omitempty" json:"errors,omitempty"`
+	Previous     *previousText        `bson:"previous,omitempty" json:"-"`
+	Pending      []previousText       `bson:"pending,omitempty" json:"-"`
+	Payload      []byte               `bson:"payload" json:"-"`
+	checked      time.Time
+	cancelled    bool
+	reported     time.Time
 }
 
 type QueueItemSlice []QueueItem
 
-func NewQueueItem(registry *registry.Registry, command string,
+func NewQueueItem(registry *registry.Registry, command string, priority Priority,
 	source *document.DocumentID, target *document.DocumentID,
 	sourceRange string, targetRange string,
 	payload io.Reader) (*QueueItem, error) {
@@ -58,6 +65,7 @@ func NewQueueItem(registry *registry.Registry, command string,
 		Id:          bson.NewObjectId(),
 		Command:     command,
 		Status:      "Queued",
+		Priority:    priority.resolve(command),
 		Source:      source,
 		Target:      target,
 		SourceRange: sourceRange,
@@ -83,6 +91,62 @@ func (q *QueueItem) UpdateStatus(registry *registry.Registry, status string) err
 	return db.C("queue").UpdateId(q.Id, bson.M{"$set": bson.M{"status": status}})
 }
 
+// Clears the lease once the item has run
+func (q *QueueItem) release() {
+	q.Worker, q.Lease, q.Retry = "", nil, nil
+}
+
+// Requeues started items whose lease has expired, which happens when a worker
+// dies mid-run. Items started before leases existed have none and are also requeued.
+// Each counts as a failed attempt, so an item which keeps killing workers ends up Dead.
+func Reap(registry *registry.Registry) (int, error) {
+	now := time.Now()
+	expired := bson.M{
+		"status": "Started",
+		"$or": []bson.M{
+			{"lease": bson.M{"$lt": now}},
+			{"lease": bson.M{"$exists": false}},
+		},
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	queue := db.C("queue")
+	var items QueueItemSlice
+	if err := queue.Find(expired).Select(bson.M{"_id": 1, "command": 1, "attempts": 1, "lease": 1, "cancel": 1}).All(&items); err != nil {
+		return 0, newQueueError("Queue Reap:", err)
+	}
+	reaped := 0
+	for _, item := range items {
+		selector := bson.M{"_id": item.Id, "status": "Started", "lease": item.Lease}
+		if item.Lease == nil {
+			selector["lease"] = bson.M{"$exists": false}
+		}
+		if item.Cancel {
+			item.Status = "Cancelled"
+		} else {
+			item.retry()
+		}
+		change := bson.M{
+			"$set":   bson.M{"status": item.Status, "attempts": item.Attempts, "error": "Lease expired"},
+			"$unset": bson.M{"worker": 1, "lease": 1},
+		}
+		if item.Retry != nil {
+			change["$set"].(bson.M)["retry"] = item.Retry
+		} else {
+			change["$set"].(bson.M)["finished"] = now
+		}
+		switch err := queue.Update(selector, change); {
+		case err == mgo.ErrNotFound:
+			// Renewed or finished since it was found
+		case err != nil:
+			return reaped, newQueueError("Queue Reap:", err)
+		default:
+			reaped++
+		}
+	}
+	return reaped, nil
+}
+
 func (q *QueueItem) getPayload() (string, error) {
 	buf := bufio.NewReader(bytes.NewBuffer(q.Payload))
 	r, err := gzip.NewReader(buf)
@@ -110,7 +174,7 @@ func (q *QueueItem) PayloadValues() (*url.Values, error) {
 
 func (q *QueueItem) Location(registry *registry.Registry) string {
 	switch q.Command {
-	case "Add Document":
+	case "Add Document", "Update Document":
 		return fmt.Sprintf("http://%s/document/%d/%d/", registry.ApiAddress, q.Target.Doctype, q.Target.Docid)
 	}
 	return ""
@@ -137,65 +201,6 @@ func (q *QueueItem) String() string {
 	return buf.String()
 }
 
-func Start(registry *registry.Registry) {
-	glog.Infoln("Starting Queue Processor")
-	registry.Queue = make(chan bool)
-	client, err := posting.NewClient(registry)
-	if err != nil {
-		panic(err)
-	}
-	defer client.Close()
-	if err = client.Initialise(); err != nil {
-		panic(err)
-	}
-	db := registry.DB()
-	defer db.Session.Close()
-	queue := db.C("queue")
-	registry.Routines.Add(1)
-	var items QueueItemSlice
-	for {
-		start := time.Now()
-		if err := queue.Find(bson.M{"status": "Queued"}).Sort("_id").Limit(10).All(&items); err != nil {
-			panic(err)
-		}
-		for i, item := range items {
-			if item.Command != items[0].Command {
-				items = items[:i]
-				break
-			}
-		}
-		if err := items.Execute(registry, client); err != nil {
-			glog.Errorln(err)
-		}
-		if len(items) > 0 {
-			glog.Infof("Executed %d Queue items in %.2f secs", len(items), time.Now().Sub(start).Seconds())
-			continue
-		}
-		select {
-		case <-registry.Queue:
-			glog.Infoln("Queue Processor Stopped")
-			registry.Routines.Done()
-			return
-		default:
-			time.Sleep(time.Second)
-		}
-	}
-}
-
-func GetQueue(values url.Values, registry *registry.Registry) (*QueueResult, error) {
-	var items []QueueItem
-	db := registry.DB()
-	defer db.Session.Close()
-	if err := db.C("queue").Find(nil).Select(bson.M{"payload": 0}).Sort("_id").All(&items); err != nil {
-		return nil, fmt.Errorf("Queue item not found: %s", err)
-	}
-	return &QueueResult{
-		Rows:      items,
-		TotalRows: len(items),
-		Success:   true,
-	}, nil
-}
-
 func getQueueItem(id bson.ObjectId, registry *registry.Registry) (*QueueItem, error) {
 	var item QueueItem
 	db := registry.DB()
@@ -4,7 +4,10 @@ import (
 	"github.com/donovanhide/superfastmatch/document"
 	"github.com/donovanhide/superfastmatch/posting"
 	"github.com/donovanhide/superfastmatch/testutils"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
 	. "launchpad.net/gocheck"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -39,7 +42,7 @@ func (s *QuerySuite) TestQueue(c *C) {
 	var err error
 	for i := uint32(1); i <= 20; i++ {
 		target := document.DocumentID{Doctype: 1, Docid: i}
-		item, err = NewQueueItem(s.Registry, "Add Document", nil, &target, "", "", strings.NewReader("title=Payload&text=PayloadWithsometextlongerthanwindowsize"))
+		item, err = NewQueueItem(s.Registry, "Add Document", DefaultPriority, nil, &target, "", "", strings.NewReader("title=Payload&text=PayloadWithsometextlongerthanwindowsize"))
 		c.Check(item, NotNil)
 		c.Check(err, IsNil)
 	}
@@ -56,7 +59,7 @@ func (s *QuerySuite) TestQueue(c *C) {
 	c.Check(count, Equals, 20)
 	for i := uint32(1); i <= 20; i++ {
 		target := document.DocumentID{Doctype: 1, Docid: i}
-		item, err = NewQueueItem(s.Registry, "Delete Document", nil, &target, "", "", strings.NewReader(""))
+		item, err = NewQueueItem(s.Registry, "Delete Document", DefaultPriority, nil, &target, "", "", strings.NewReader(""))
 		c.Check(item, NotNil)
 		c.Check(err, IsNil)
 	}
@@ -74,7 +77,7 @@ func (s *QuerySuite) TestQueue(c *C) {
 func (s *QuerySuite) TestPayload(c *C) {
 	go Start(s.Registry)
 	go posting.Serve(s.Registry)
-	item, err := NewQueueItem(s.Registry, "test", nil, nil, "", "", strings.NewReader("I am the payload"))
+	item, err := NewQueueItem(s.Registry, "test", DefaultPriority, nil, nil, "", "", strings.NewReader("I am the payload"))
 	c.Check(err, IsNil)
 	var q QueueItem
 	db := s.Registry.DB()
@@ -89,10 +92,361 @@ func (s *QuerySuite) TestPayload(c *C) {
 func (s *QuerySuite) TestAssociate(c *C) {
 	go Start(s.Registry)
 	go posting.Serve(s.Registry)
-	item, err := NewQueueItem(s.Registry, "Test Corpus", nil, nil, "", "", strings.NewReader(""))
+	item, err := NewQueueItem(s.Registry, "Test Corpus", DefaultPriority, nil, nil, "", "", strings.NewReader(""))
 	c.Check(err, IsNil)
 	c.Check(waitForItem(item, s), IsNil)
-	item, err = NewQueueItem(s.Registry, "Associate Document", nil, nil, "1", "2-10", strings.NewReader(""))
+	item, err = NewQueueItem(s.Registry, "Associate Document", DefaultPriority, nil, nil, "1", "2-10", strings.NewReader(""))
 	c.Check(err, IsNil)
 	c.Check(waitForItem(item, s), IsNil)
 }
+
+func (s *QuerySuite) TestReap(c *C) {
+	expired, current := time.Now().Add(-time.Minute), time.Now().Add(time.Minute)
+	items := []QueueItem{
+		{Id: bson.NewObjectId(), Command: "Add Document", Status: "Started", Worker: "dead:1", Lease: &expired},
+		{Id: bson.NewObjectId(), Command: "Add Document", Status: "Started", Worker: "alive:1", Lease: &current},
+		{Id: bson.NewObjectId(), Command: "Test Corpus", Status: "Started"},
+	}
+	for i := range items {
+		c.Assert(items[i].Save(s.Registry), IsNil)
+	}
+	n, err := Reap(s.Registry)
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 2)
+	for i, status := range []string{"Queued", "Started", "Dead"} {
+		item, err := getQueueItem(items[i].Id, s.Registry)
+		c.Assert(err, IsNil)
+		c.Check(item.Status, Equals, status)
+	}
+	item, err := getQueueItem(items[0].Id, s.Registry)
+	c.Check(err, IsNil)
+	c.Check(item.Attempts, Equals, 1)
+	c.Check(item.Worker, Equals, "")
+	c.Check(item.Lease, IsNil)
+	c.Check(item.Retry, NotNil)
+	result, err := Requeue(url.Values{}, s.Registry)
+	c.Check(err, IsNil)
+	c.Check(result.Requeued, Equals, 1)
+	item, err = getQueueItem(items[2].Id, s.Registry)
+	c.Check(err, IsNil)
+	c.Check(item.Status, Equals, "Queued")
+	c.Check(item.Attempts, Equals, 0)
+}
+
+func (s *QuerySuite) TestClaim(c *C) {
+	commands := []struct {
+		command  string
+		priority Priority
+		target   *document.DocumentID
+	}{
+		{"Associate Document", DefaultPriority, nil},
+		{"Associate Document", DefaultPriority, nil},
+		{"Add Document", DefaultPriority, &document.DocumentID{Doctype: 1, Docid: 1}},
+		{"Add Document", DefaultPriority, &document.DocumentID{Doctype: 1, Docid: 1}},
+		{"Add Document", Bulk, &document.DocumentID{Doctype: 1, Docid: 2}},
+	}
+	ids := make([]bson.ObjectId, len(commands))
+	for i, command := range commands {
+		item, err := NewQueueItem(s.Registry, command.command, command.priority, nil, command.target, "", "", strings.NewReader(""))
+		c.Assert(err, IsNil)
+		ids[i] = item.Id
+	}
+	db := s.Registry.DB()
+	defer db.Session.Close()
+	w := newWorker(s.Registry, nil, db.C("queue"))
+	// Interactive before bulk before background, skipping the busy target and the full command
+	for _, i := range []int{2, 4, 0} {
+		item, err := w.claim()
+		c.Assert(err, IsNil)
+		c.Check(item.Id, Equals, ids[i])
+		c.Check(item.Status, Equals, "Started")
+		c.Check(item.Worker, Equals, s.Registry.WorkerId)
+		c.Check(item.Lease, NotNil)
+		w.running[item.Id] = item
+		w.commands[item.Command]++
+	}
+	_, err := w.claim()
+	c.Check(err, Equals, mgo.ErrNotFound)
+}
+
+func (s *QuerySuite) TestLock(c *C) {
+	db := s.Registry.DB()
+	defer db.Session.Close()
+	w := newWorker(s.Registry, nil, db.C("queue"))
+	target := &document.DocumentID{Doctype: 1, Docid: 1}
+	items := make([]*QueueItem, 3)
+	for i := range items {
+		item, err := NewQueueItem(s.Registry, "Cluster Documents", DefaultPriority, nil, target, "", "", strings.NewReader(""))
+		c.Assert(err, IsNil)
+		items[i] = item
+	}
+	start := func(item *QueueItem, worker string) {
+		c.Assert(db.C("queue").UpdateId(item.Id, bson.M{"$set": bson.M{"status": "Started", "worker": worker}}), IsNil)
+	}
+	c.Check(lockKeys(items[0]), DeepEquals, []string{"lock:target:1/1", "lock:command:Cluster Documents"})
+	// Held by an item another worker is still running
+	start(items[0], "other:1")
+	start(items[1], s.Registry.WorkerId)
+	c.Assert(db.C("settings").Insert(queueLock{"lock:target:1/1", items[0].Id, "other:1"}), IsNil)
+	c.Check(w.lockItem(items[1]), Equals, errLocked)
+	held := new(QueueItem)
+	c.Assert(db.C("queue").FindId(items[1].Id).One(held), IsNil)
+	c.Check(held.Status, Equals, "Queued")
+	c.Check(held.Worker, Equals, "")
+	// Left behind by an item which has since been reaped
+	c.Assert(db.C("queue").UpdateId(items[0].Id, bson.M{"$set": bson.M{"status": "Queued"}}), IsNil)
+	start(items[1], s.Registry.WorkerId)
+	c.Check(w.lockItem(items[1]), IsNil)
+	locked, err := w.lock("lock:target:1/1", items[1])
+	c.Check(err, IsNil)
+	c.Check(locked, Equals, true)
+	locked, err = w.lock("lock:command:Cluster Documents", items[2])
+	c.Check(err, IsNil)
+	c.Check(locked, Equals, false)
+	c.Assert(w.unlock(items[1]), IsNil)
+	n, err := db.C("settings").Find(bson.M{"item": items[1].Id}).Count()
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 0)
+}
+
+func (s *QuerySuite) TestFinish(c *C) {
+	db := s.Registry.DB()
+	defer db.Session.Close()
+	w := newWorker(s.Registry, nil, db.C("queue"))
+	claimed := func() *QueueItem {
+		_, err := NewQueueItem(s.Registry, "Add Document", DefaultPriority, nil, nil, "", "", strings.NewReader("payload"))
+		c.Assert(err, IsNil)
+		item, err := w.claim()
+		c.Assert(err, IsNil)
+		w.running[item.Id] = item
+		w.commands[item.Command]++
+		return item
+	}
+	// Reclaimed by another worker after the lease expired
+	item := claimed()
+	c.Assert(db.C("queue").UpdateId(item.Id, bson.M{"$set": bson.M{"worker": "other:1"}}), IsNil)
+	c.Assert(w.finish(runSuccess(item)), IsNil)
+	saved, err := getQueueItem(item.Id, s.Registry)
+	c.Assert(err, IsNil)
+	c.Check(saved.Status, Equals, "Started")
+	c.Check(saved.Worker, Equals, "other:1")
+	// Flagged for cancellation while running
+	item = claimed()
+	c.Assert(db.C("queue").UpdateId(item.Id, bson.M{"$set": bson.M{"cancel": true}}), IsNil)
+	c.Assert(w.finish(runSuccess(item)), IsNil)
+	saved = new(QueueItem)
+	c.Assert(db.C("queue").FindId(item.Id).One(saved), IsNil)
+	c.Check(saved.Status, Equals, "Completed")
+	c.Check(saved.Cancel, Equals, true)
+	c.Check(saved.Worker, Equals, "")
+	c.Check(saved.Lease, IsNil)
+	c.Check(saved.Finished, NotNil)
+	c.Check(saved.Payload, IsNil)
+}
+
+func (s *QuerySuite) TestCancel(c *C) {
+	statuses := []string{"Queued", "Started", "Completed"}
+	items := make([]*QueueItem, len(statuses))
+	for i, status := range statuses {
+		item, err := NewQueueItem(s.Registry, "Associate Document", DefaultPriority, nil, nil, "1", "2-10", strings.NewReader(""))
+		c.Assert(err, IsNil)
+		item.Status = status
+		c.Assert(item.Save(s.Registry), IsNil)
+		items[i] = item
+	}
+	values := func(item *QueueItem) url.Values {
+		return url.Values{"id": []string{item.Id.Hex()}}
+	}
+	item, err := CancelQueueItem(values(items[0]), s.Registry)
+	c.Check(err, IsNil)
+	c.Check(item.Status, Equals, "Cancelled")
+	c.Check(items[1].Cancelled(s.Registry), Equals, false)
+	item, err = CancelQueueItem(values(items[1]), s.Registry)
+	c.Check(err, IsNil)
+	c.Check(item.Status, Equals, "Started")
+	c.Check(item.Cancel, Equals, true)
+	items[1].checked = time.Time{}
+	c.Check(items[1].Cancelled(s.Registry), Equals, true)
+	_, err = CancelQueueItem(values(items[2]), s.Registry)
+	c.Check(err, Equals, ErrNotCancellable)
+}
+
+func (s *QuerySuite) TestPause(c *C) {
+	db := s.Registry.DB()
+	defer db.Session.Close()
+	paused, err := isPaused(db)
+	c.Check(err, IsNil)
+	c.Check(paused, Equals, false)
+	result, err := SetPaused(s.Registry, true)
+	c.Check(err, IsNil)
+	c.Check(result.Paused, Equals, true)
+	paused, err = isPaused(db)
+	c.Check(err, IsNil)
+	c.Check(paused, Equals, true)
+	queue, err := s.getQueue(c, url.Values{})
+	c.Check(err, IsNil)
+	c.Check(queue.Paused, Equals, true)
+}
+
+func (s *QuerySuite) getQueue(c *C, values url.Values) (*QueueResult, error) {
+	q, err := NewQueueQuery(values)
+	c.Assert(err, IsNil)
+	return q.GetQueue(s.Registry)
+}
+
+func (s *QuerySuite) TestListAndPurge(c *C) {
+	for i := uint32(1); i <= 5; i++ {
+		target := document.DocumentID{Doctype: i % 2, Docid: i}
+		item, err := NewQueueItem(s.Registry, "Add Document", DefaultPriority, nil, &target, "", "", strings.NewReader(""))
+		c.Assert(err, IsNil)
+		if i <= 2 {
+			finished := time.Now().Add(-2 * s.Registry.QueueRetention)
+			item.Status, item.Finished = "Completed", &finished
+		}
+		if i == 3 {
+			item.Status = "Failed"
+		}
+		c.Assert(item.Save(s.Registry), IsNil)
+	}
+	result, err := s.getQueue(c, url.Values{"limit": {"2"}})
+	c.Check(err, IsNil)
+	c.Check(result.TotalRows, Equals, 5)
+	c.Check(result.Rows, HasLen, 2)
+	c.Assert(result.Cursor, Not(Equals), "")
+	result, err = s.getQueue(c, url.Values{"limit": {"2"}, "cursor": {result.Cursor}})
+	c.Check(err, IsNil)
+	c.Check(result.Rows, HasLen, 2)
+	c.Check(result.Rows[0].Status, Equals, "Failed")
+	result, err = s.getQueue(c, url.Values{"status": {"Queued"}, "doctypes": {"1"}})
+	c.Check(err, IsNil)
+	c.Check(result.TotalRows, Equals, 1)
+	n, err := Purge(s.Registry)
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 2)
+	failed, err := s.getQueue(c, url.Values{"status": {"Failed"}})
+	c.Assert(err, IsNil)
+	c.Assert(failed.Rows, HasLen, 1)
+	_, err = AcknowledgeQueueItem(url.Values{"id": {failed.Rows[0].Id.Hex()}}, s.Registry)
+	c.Check(err, IsNil)
+	n, err = Purge(s.Registry)
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 1)
+}
+
+func (s *QuerySuite) TestProgress(c *C) {
+	item, err := NewQueueItem(s.Registry, "Associate Document", DefaultPriority, nil, nil, "1", "2-10", strings.NewReader(""))
+	c.Assert(err, IsNil)
+	item.Report(s.Registry, 0, 4, "1/1")
+	c.Check(item.Progress.ETA, IsNil)
+	item.Progress.Started = time.Now().Add(-time.Minute)
+	item.Report(s.Registry, 2, 4, "1/3")
+	c.Assert(item.Progress.ETA, NotNil)
+	c.Check(item.Progress.ETA.Sub(time.Now()) > 50*time.Second, Equals, true)
+	item.Report(s.Registry, 4, 4, "")
+	saved, err := getQueueItem(item.Id, s.Registry)
+	c.Assert(err, IsNil)
+	c.Assert(saved.Progress, NotNil)
+	c.Check(saved.Progress.Processed, Equals, 4)
+	c.Check(saved.Progress.Total, Equals, 4)
+}
+
+func (s *QuerySuite) TestDeleteRange(c *C) {
+	go Start(s.Registry)
+	go posting.Serve(s.Registry)
+	item, err := NewQueueItem(s.Registry, "Test Corpus", DefaultPriority, nil, nil, "", "", strings.NewReader(""))
+	c.Check(err, IsNil)
+	c.Check(waitForItem(item, s), IsNil)
+	item, err = NewQueueItem(s.Registry, "Associate Document", DefaultPriority, nil, nil, "2-10", "1-10", strings.NewReader(""))
+	c.Check(err, IsNil)
+	c.Check(waitForItem(item, s), IsNil)
+	result, err := document.CountDocuments("1", s.Registry)
+	c.Check(err, IsNil)
+	c.Check(result.Count > 0, Equals, true)
+	item, err = NewQueueItem(s.Registry, "Delete Documents", DefaultPriority, nil, nil, "1", "", strings.NewReader(""))
+	c.Check(err, IsNil)
+	c.Check(waitForItem(item, s), IsNil)
+	result, err = document.CountDocuments("1", s.Registry)
+	c.Check(err, IsNil)
+	c.Check(result.Count, Equals, 0)
+	db := s.Registry.DB()
+	defer db.Session.Close()
+	n, err := db.C("associations").Find(bson.M{"_id.target.doctype": 1}).Count()
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 0)
+	n, err = db.C("documents").Find(bson.M{"associations.document._id.doctype": 1}).Count()
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 0)
+}
+
+func searchFinds(c *C, client *posting.Client, text string, id document.DocumentID) bool {
+	group, err := client.Search(&document.DocumentArg{Text: text})
+	c.Assert(err, IsNil)
+	for _, results := range *group {
+		if results[id] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *QuerySuite) TestRetryUpdate(c *C) {
+	go posting.Serve(s.Registry)
+	client, err := posting.NewClient(s.Registry)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	c.Assert(client.Initialise(), IsNil)
+	target := document.DocumentID{Doctype: 1, Docid: 1}
+	shared, original, replacement := document.RandomWords(200), document.RandomWords(200), document.RandomWords(200)
+	payload := url.Values{"title": {"Original"}, "text": {shared + original}}
+	item, err := NewQueueItem(s.Registry, "Add Document", DefaultPriority, nil, &target, "", "", strings.NewReader(payload.Encode()))
+	c.Assert(err, IsNil)
+	c.Assert(addDocument(item, s.Registry, client, false).err, IsNil)
+	payload = url.Values{"title": {"Replacement"}, "text": {shared + replacement}}
+	item, err = NewQueueItem(s.Registry, "Update Document", DefaultPriority, nil, &target, "", "", strings.NewReader(payload.Encode()))
+	c.Assert(err, IsNil)
+	broken, err := posting.NewClient(s.Registry)
+	c.Assert(err, IsNil)
+	broken.Close()
+	run := addDocument(item, s.Registry, broken, true)
+	c.Check(run.err, NotNil)
+	c.Check(run.retry, Equals, true)
+	db := s.Registry.DB()
+	defer db.Session.Close()
+	retried := new(QueueItem)
+	c.Assert(db.C("queue").FindId(item.Id).One(retried), IsNil)
+	c.Assert(retried.Previous, NotNil)
+	c.Check(retried.Previous.Text, Equals, shared+original)
+	c.Assert(addDocument(retried, s.Registry, client, true).err, IsNil)
+	c.Check(searchFinds(c, client, original, target), Equals, false)
+	c.Check(searchFinds(c, client, replacement, target), Equals, true)
+	c.Check(searchFinds(c, client, shared, target), Equals, true)
+}
+
+func (s *QuerySuite) TestRetryBulkBatch(c *C) {
+	go posting.Serve(s.Registry)
+	client, err := posting.NewClient(s.Registry)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	c.Assert(client.Initialise(), IsNil)
+	item, err := NewBulkItem(s.Registry, DefaultPriority, strings.NewReader(""))
+	c.Assert(err, IsNil)
+	shared, original, replacement := document.RandomWords(200), document.RandomWords(200), document.RandomWords(200)
+	doc, err := document.BuildDocument(1, 1, "Original", shared+original, nil)
+	c.Assert(err, IsNil)
+	c.Assert(item.addBatch(s.Registry, client, []*document.Document{doc}), IsNil)
+	doc, err = document.BuildDocument(1, 1, "Replacement", shared+replacement, nil)
+	c.Assert(err, IsNil)
+	broken, err := posting.NewClient(s.Registry)
+	c.Assert(err, IsNil)
+	broken.Close()
+	c.Check(item.addBatch(s.Registry, broken, []*document.Document{doc}), NotNil)
+	db := s.Registry.DB()
+	defer db.Session.Close()
+	retried := new(QueueItem)
+	c.Assert(db.C("queue").FindId(item.Id).One(retried), IsNil)
+	c.Assert(retried.Pending, HasLen, 1)
+	c.Assert(retried.addBatch(s.Registry, client, []*document.Document{doc}), IsNil)
+	c.Check(retried.Pending, HasLen, 0)
+	c.Check(searchFinds(c, client, original, doc.Id), Equals, false)
+	c.Check(searchFinds(c, client, replacement, doc.Id), Equals, true)
+}
@@ -0,0 +1,119 @@
+package queue
+
+import (
+	"github.com/donovanhide/superfastmatch/registry"
+	"io"
+	"labix.org/v2/mgo/bson"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A command is run at most Attempts times. Each retry waits twice as long as
+// the previous one, up to MaxBackoff, less a random jitter of up to half.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+type RequeueResult struct {
+	Success  bool `json:"success"`
+	Requeued int  `json:"requeued"`
+}
+
+var defaultRetryPolicy = RetryPolicy{Attempts: 5, Backoff: 2 * time.Second, MaxBackoff: 5 * time.Minute}
+
+var retryPolicies = map[string]RetryPolicy{
+	"Associate Document": {Attempts: 3, Backoff: 10 * time.Second, MaxBackoff: 10 * time.Minute},
+	"Test Corpus":        {Attempts: 1},
+	"Find Repeats":       {Attempts: 3, Backoff: 30 * time.Second, MaxBackoff: 10 * time.Minute},
+	"Cluster Documents":  {Attempts: 3, Backoff: 30 * time.Second, MaxBackoff: 10 * time.Minute},
+	"Reindex":            {Attempts: 3, Backoff: 30 * time.Second, MaxBackoff: 10 * time.Minute},
+}
+
+// Messages of errors from mgo which only have a string to go on
+var retryableMessages = []string{
+	"no reachable servers",
+	"Closed explicitly",
+	"i/o timeout",
+	"connection reset by peer",
+}
+
+func retryPolicy(command string) RetryPolicy {
+	if policy, ok := retryPolicies[command]; ok {
+		return policy
+	}
+	return defaultRetryPolicy
+}
+
+// Returns how long to wait before the given attempt, counting from 1
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// Whether another attempt has a chance of succeeding. Lost connections to
+// mongo and the posting servers are retryable, everything else, such as a
+// document without a title, is permanent.
+func retryable(err error) bool {
+	switch err {
+	case nil:
+		return false
+	case io.EOF, io.ErrUnexpectedEOF, rpc.ErrShutdown:
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	for _, message := range retryableMessages {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// Queues a failed item again after the policy's backoff, or marks it Dead
+// once it has no attempts left.
+func (q *QueueItem) retry() {
+	q.Attempts++
+	policy := retryPolicy(q.Command)
+	if q.Attempts >= policy.Attempts {
+		q.Status = "Dead"
+		return
+	}
+	next := time.Now().Add(policy.delay(q.Attempts))
+	q.Status, q.Retry = "Queued", &next
+}
+
+// Queues Dead items again with their attempts reset, optionally only those for a command
+func Requeue(values url.Values, registry *registry.Registry) (*RequeueResult, error) {
+	query := bson.M{"status": "Dead"}
+	if command := values.Get("command"); command != "" {
+		query["command"] = command
+	}
+	change := bson.M{
+		"$set":   bson.M{"status": "Queued", "attempts": 0, "error": ""},
+		"$unset": bson.M{"retry": 1, "finished": 1, "acknowledged": 1},
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	info, err := db.C("queue").UpdateAll(query, change)
+	if err != nil {
+		return nil, newQueueError("Queue Requeue:", err)
+	}
+	return &RequeueResult{Success: true, Requeued: info.Updated}, nil
+}
@@ -0,0 +1,49 @@
+package queue
+
+import (
+	"errors"
+	"io"
+	. "launchpad.net/gocheck"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+type RetrySuite struct{}
+
+var _ = Suite(&RetrySuite{})
+
+func (s *RetrySuite) TestDelay(c *C) {
+	policy := RetryPolicy{Attempts: 10, Backoff: time.Second, MaxBackoff: 10 * time.Second}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		d := policy.delay(attempt + 1)
+		c.Check(d <= max, Equals, true)
+		c.Check(d >= max/2, Equals, true)
+	}
+	c.Check(RetryPolicy{Attempts: 1}.delay(1), Equals, time.Duration(0))
+}
+
+func (s *RetrySuite) TestRetryable(c *C) {
+	c.Check(retryable(nil), Equals, false)
+	c.Check(retryable(io.EOF), Equals, true)
+	c.Check(retryable(rpc.ErrShutdown), Equals, true)
+	c.Check(retryable(&net.OpError{Op: "dial", Err: errors.New("connection refused")}), Equals, true)
+	c.Check(retryable(errors.New("no reachable servers")), Equals, true)
+	c.Check(retryable(errors.New("Missing title or text fields")), Equals, false)
+	c.Check(retryable(rpc.ServerError("Bad doctype")), Equals, false)
+}
+
+func (s *RetrySuite) TestRetry(c *C) {
+	item := &QueueItem{Command: "Add Document", Status: "Started"}
+	for i := 1; i < defaultRetryPolicy.Attempts; i++ {
+		item.retry()
+		c.Check(item.Status, Equals, "Queued")
+		c.Check(item.Attempts, Equals, i)
+		c.Check(item.Retry.After(time.Now()), Equals, true)
+	}
+	item.retry()
+	c.Check(item.Status, Equals, "Dead")
+	item = &QueueItem{Command: "Test Corpus"}
+	item.retry()
+	c.Check(item.Status, Equals, "Dead")
+}
@@ -0,0 +1,394 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"github.com/donovanhide/superfastmatch/document"
+	"github.com/donovanhide/superfastmatch/posting"
+	"github.com/donovanhide/superfastmatch/registry"
+	"github.com/golang/glog"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"time"
+)
+
+// The number of items of a command a worker runs at once, so that long scans
+// over ranges don't hold up changes to single documents. Other commands may
+// use all of the worker's concurrency.
+var commandSlots = map[string]int{
+	"Associate Document": 1,
+	"Test Corpus":        1,
+	"Find Repeats":       1,
+	"Cluster Documents":  1,
+	"Bulk Add":           1,
+	"Delete Documents":   1,
+	"Reindex":            1,
+	"Fill Signatures":    1,
+}
+
+// Commands which run one item at a time across every worker
+var exclusiveCommands = []string{"Cluster Documents"}
+
+// Returned by claim when another worker holds a lock the claimed item needs
+var errLocked = errors.New("Queue Item locked by another worker")
+
+// How often a worker removes items past the retention period
+const purgeInterval = 10 * time.Minute
+
+type worker struct {
+	registry *registry.Registry
+	client   *posting.Client
+	queue    *mgo.Collection
+	running  map[bson.ObjectId]*QueueItem
+	commands map[string]int
+	results  chan *QueueItemRun
+	paused   bool
+}
+
+func newWorker(registry *registry.Registry, client *posting.Client, queue *mgo.Collection) *worker {
+	return &worker{
+		registry: registry,
+		client:   client,
+		queue:    queue,
+		running:  make(map[bson.ObjectId]*QueueItem),
+		commands: make(map[string]int),
+		results:  make(chan *QueueItemRun, registry.QueueConcurrency),
+	}
+}
+
+func (w *worker) slots(command string) int {
+	if n, ok := commandSlots[command]; ok && n < w.registry.QueueConcurrency {
+		return n
+	}
+	return w.registry.QueueConcurrency
+}
+
+// Commands with every slot in use
+func (w *worker) full() []string {
+	full := make([]string, 0)
+	for command, n := range w.commands {
+		if n >= w.slots(command) {
+			full = append(full, command)
+		}
+	}
+	return full
+}
+
+// Atomically claims the ready item with the highest priority for which this
+// worker has a free slot. Items whose target document is being run by any
+// worker are left for later, so that changes to a document are applied in
+// order, as are exclusive commands already being run by any worker. Two
+// workers claiming at once can both pass those checks, so the claimed item
+// then takes its locks and is handed back if another worker holds one.
+func (w *worker) claim() (*QueueItem, error) {
+	var busy []document.DocumentID
+	if err := w.queue.Find(bson.M{"status": "Started", "target": bson.M{"$ne": nil}}).Distinct("target", &busy); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ready := bson.M{
+		"status": "Queued",
+		"$or": []bson.M{
+			{"retry": bson.M{"$exists": false}},
+			{"retry": bson.M{"$lte": now}},
+		},
+	}
+	var exclusive []string
+	if err := w.queue.Find(bson.M{"status": "Started", "command": bson.M{"$in": exclusiveCommands}}).Distinct("command", &exclusive); err != nil {
+		return nil, err
+	}
+	if full := append(w.full(), exclusive...); len(full) > 0 {
+		ready["command"] = bson.M{"$nin": full}
+	}
+	if len(busy) > 0 {
+		ready["target"] = bson.M{"$nin": busy}
+	}
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"status": "Started", "worker": w.registry.WorkerId, "lease": now.Add(w.registry.QueueLease)}},
+		ReturnNew: true,
+	}
+	item := new(QueueItem)
+	if _, err := w.queue.Find(ready).Sort("priority", "_id").Apply(change, item); err != nil {
+		return nil, err
+	}
+	if err := w.lockItem(item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+type queueLock struct {
+	Id     string        `bson:"_id"`
+	Item   bson.ObjectId `bson:"item"`
+	Worker string        `bson:"worker"`
+}
+
+// The locks an item holds in settings while it runs, one for its target
+// document and one for its command if that is exclusive. They are always
+// taken in this order.
+func lockKeys(item *QueueItem) []string {
+	keys := make([]string, 0, 2)
+	if item.Target != nil {
+		keys = append(keys, fmt.Sprintf("lock:target:%d/%d", item.Target.Doctype, item.Target.Docid))
+	}
+	for _, command := range exclusiveCommands {
+		if item.Command == command {
+			keys = append(keys, "lock:command:"+command)
+		}
+	}
+	return keys
+}
+
+// Takes the lock unless it is held by an item which is still running. Locks
+// left behind by items which have finished or been reaped are taken over,
+// replacing the exact holder found so that only one worker can succeed.
+func (w *worker) lock(key string, item *QueueItem) (bool, error) {
+	settings := w.queue.Database.C("settings")
+	mine := queueLock{Id: key, Item: item.Id, Worker: w.registry.WorkerId}
+	err := settings.Insert(&mine)
+	if !mgo.IsDup(err) {
+		return err == nil, err
+	}
+	var held queueLock
+	switch err := settings.FindId(key).One(&held); {
+	case err == mgo.ErrNotFound:
+		return false, nil
+	case err != nil:
+		return false, err
+	case held == mine:
+		return true, nil
+	}
+	running, err := w.queue.Find(bson.M{"_id": held.Item, "worker": held.Worker, "status": "Started"}).Count()
+	if err != nil || running > 0 {
+		return false, err
+	}
+	switch err := settings.Update(held, mine); {
+	case err == mgo.ErrNotFound:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// Takes every lock of a claimed item, or releases those taken and requeues the item
+func (w *worker) lockItem(item *QueueItem) error {
+	for _, key := range lockKeys(item) {
+		locked, err := w.lock(key, item)
+		if locked {
+			continue
+		}
+		if uerr := w.unlock(item); uerr != nil {
+			return uerr
+		}
+		query := bson.M{"_id": item.Id, "worker": w.registry.WorkerId, "status": "Started"}
+		uerr := w.queue.Update(query, bson.M{"$set": bson.M{"status": "Queued"}, "$unset": bson.M{"worker": 1, "lease": 1}})
+		if uerr != nil && uerr != mgo.ErrNotFound {
+			return uerr
+		}
+		if err != nil {
+			return err
+		}
+		return errLocked
+	}
+	return nil
+}
+
+func (w *worker) unlock(item *QueueItem) error {
+	query := bson.M{"_id": bson.M{"$in": lockKeys(item)}, "item": item.Id, "worker": w.registry.WorkerId}
+	_, err := w.queue.Database.C("settings").RemoveAll(query)
+	return err
+}
+
+// Claims and runs items until the worker is at its concurrency or none are ready
+func (w *worker) fill() error {
+	for len(w.running) < w.registry.QueueConcurrency {
+		item, err := w.claim()
+		switch {
+		case err == mgo.ErrNotFound, err == errLocked:
+			return nil
+		case err != nil:
+			return newQueueError("Queue Claim:", err)
+		}
+		w.run(item)
+	}
+	return nil
+}
+
+func (w *worker) run(item *QueueItem) {
+	// Progress is reported afresh by each attempt
+	item.Progress = nil
+	w.running[item.Id] = item
+	w.commands[item.Command]++
+	f, ok := commandMap[item.Command]
+	if !ok {
+		w.results <- runFailure(item, "Execute", errors.New("Command does not exist!"))
+		return
+	}
+	go f(item, w.registry, w.client, w.results)
+}
+
+func (w *worker) finish(run *QueueItemRun) error {
+	delete(w.running, run.item.Id)
+	w.commands[run.item.Command]--
+	run.item.release()
+	switch {
+	case run.err == errCancelled, run.err != nil && run.retry && run.item.Cancelled(w.registry):
+		run.item.Status = "Cancelled"
+		glog.Infof("Cancelled Queue Item: %v", run.item)
+	case run.err != nil && run.retry:
+		run.item.Error = run.err.Error()
+		run.item.retry()
+		glog.Errorf("%s Queue Item after %d attempts: %v Error: %s", run.item.Status, run.item.Attempts, run.item, run.err)
+	case run.err != nil:
+		run.item.Status = "Failed"
+		run.item.Error = run.err.Error()
+		glog.Errorf("Failed Queue Item: %v Error: %s", run.item, run.err)
+	default:
+		run.item.Status = "Completed"
+	}
+	if run.item.Status != "Queued" {
+		finished := time.Now()
+		run.item.Finished = &finished
+	}
+	return w.save(run.item)
+}
+
+// Only sets the fields the worker owns, and only while it still holds the
+// item, so that an item reclaimed after its lease expired, or flagged for
+// cancellation, isn't overwritten with a stale copy. The item's locks are
+// released afterwards.
+func (w *worker) save(item *QueueItem) error {
+	set := bson.M{"status": item.Status, "error": item.Error, "attempts": item.Attempts}
+	unset := bson.M{"worker": 1, "lease": 1}
+	if item.Retry != nil {
+		set["retry"] = item.Retry
+	} else {
+		unset["retry"] = 1
+	}
+	if item.Finished != nil {
+		set["finished"] = item.Finished
+	}
+	if item.Progress != nil {
+		set["progress"] = item.Progress
+	}
+	if item.Errors != nil {
+		set["errors"] = item.Errors
+	}
+	if item.Status == "Completed" {
+		unset["payload"], unset["previous"], unset["pending"] = 1, 1, 1
+	}
+	query := bson.M{"_id": item.Id, "worker": w.registry.WorkerId, "status": "Started"}
+	switch err := w.queue.Update(query, bson.M{"$set": set, "$unset": unset}); {
+	case err == mgo.ErrNotFound:
+		glog.Warningf("Queue Item no longer held by %s, dropping result: %v", w.registry.WorkerId, item)
+	case err != nil:
+		return newQueueError("Queue Item save:", err)
+	}
+	if err := w.unlock(item); err != nil {
+		return newQueueError("Queue Item unlock:", err)
+	}
+	return nil
+}
+
+// Extends the leases of the items this worker is still running
+func (w *worker) renew() error {
+	if len(w.running) == 0 {
+		return nil
+	}
+	ids := make([]bson.ObjectId, 0, len(w.running))
+	for id := range w.running {
+		ids = append(ids, id)
+	}
+	query := bson.M{"_id": bson.M{"$in": ids}, "status": "Started", "worker": w.registry.WorkerId}
+	_, err := w.queue.UpdateAll(query, bson.M{"$set": bson.M{"lease": time.Now().Add(w.registry.QueueLease)}})
+	return err
+}
+
+// Runs queue items until registry.Queue is signalled, finishing any in flight.
+// Callers running Start in its own goroutine should create registry.Queue
+// first, so that Registry.Close can't miss it.
+// Any number of workers may run against the same database. Those started in
+// queue mode leave initialising the posting servers to the api process.
+func Start(registry *registry.Registry) {
+	glog.Infof("Starting Queue Processor %s with concurrency %d", registry.WorkerId, registry.QueueConcurrency)
+	if registry.Queue == nil {
+		registry.Queue = make(chan bool)
+	}
+	registry.Routines.Add(1)
+	defer registry.Routines.Done()
+	client, err := posting.NewClient(registry)
+	if err != nil {
+		panic(err)
+	}
+	defer client.Close()
+	if registry.Mode == "queue" {
+		if err = document.LoadIgnores(registry); err != nil {
+			panic(err)
+		}
+	} else if err = client.Initialise(); err != nil {
+		panic(err)
+	}
+	db := registry.DB()
+	defer db.Session.Close()
+	w := newWorker(registry, client, db.C("queue"))
+	ticker := time.NewTicker(registry.QueueLease / 3)
+	defer ticker.Stop()
+	var reaped, purged time.Time
+	stopping := false
+	for {
+		switch {
+		case stopping && len(w.running) == 0:
+			glog.Infoln("Queue Processor Stopped")
+			return
+		case !stopping:
+			now := time.Now()
+			if now.Sub(reaped) > registry.QueueLease/2 {
+				if n, err := Reap(registry); err != nil {
+					glog.Errorln(err)
+				} else if n > 0 {
+					glog.Infof("Requeued %d Queue items with expired leases", n)
+				}
+				reaped = now
+			}
+			if now.Sub(purged) > purgeInterval {
+				if n, err := Purge(registry); err != nil {
+					glog.Errorln(err)
+				} else if n > 0 {
+					glog.Infof("Purged %d finished Queue items", n)
+				}
+				purged = now
+			}
+			if err := document.RefreshIgnores(registry); err != nil {
+				glog.Errorln(err)
+			}
+			paused, err := isPaused(db)
+			if err != nil {
+				glog.Errorln(err)
+			}
+			if paused != w.paused {
+				glog.Infof("Queue Processor Paused: %v", paused)
+				w.paused = paused
+			}
+			if !paused {
+				if err := w.fill(); err != nil {
+					glog.Errorln(err)
+				}
+			}
+		}
+		select {
+		case run := <-w.results:
+			if err := w.finish(run); err != nil {
+				glog.Errorln(err)
+			}
+		case <-ticker.C:
+			if err := w.renew(); err != nil {
+				glog.Errorln(err)
+			}
+		case <-registry.Queue:
+			glog.Infof("Queue Processor Stopping, waiting for %d items", len(w.running))
+			stopping = true
+		case <-time.After(time.Second):
+		}
+	}
+}
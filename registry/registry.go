@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"sync"
+	"time"
 )
 
 type flags struct {
@@ -20,9 +21,24 @@ type flags struct {
 	PostingAddresses addresses
 	Feeds            string
 	InitialQuery     query
+	MetaIndexes      fields
+	Indexes          indexes
+	DateField        string
+	QueueLease       time.Duration
+	QueueConcurrency int
+	QueueRetention   time.Duration
+}
+
+// A named set of posting servers hashing with their own window size and hash width
+type IndexConfig struct {
+	Name       string
+	WindowSize uint64
+	HashWidth  uint64
+	Addresses  []string
 }
 
 type PostingConfig struct {
+	Index        string
 	Address      string
 	HashWidth    uint64
 	WindowSize   uint64
@@ -42,11 +58,19 @@ type Registry struct {
 	ApiAddress       string
 	PostingListeners []net.Listener
 	PostingConfigs   []PostingConfig
+	Indexes          []IndexConfig
+	DateField        string
+	WorkerId         string
+	QueueLease       time.Duration
+	QueueConcurrency int
+	QueueRetention   time.Duration
 	Feeds            string
 	session          *mgo.Session
 	flags            *flags
 }
 
+const DefaultIndex = "default"
+
 var f = flags{
 	WindowSize:       30,
 	HashWidth:        24,
@@ -68,6 +92,12 @@ func init() {
 	flag.StringVar(&f.MongoUrl, "mongo_url", "127.0.0.1:27017/superfastmatch", "Url to connect to MongoDB with.")
 	flag.Var(&f.PostingAddresses, "posting_addresses", "Comma-separated list of addresses for Posting Servers.")
 	flag.StringVar(&f.Feeds, "feeds", "", "Path to JSON file containing feed configuration.")
+	flag.Var(&f.MetaIndexes, "meta_indexes", "Comma-separated list of meta fields to index for filtering, eg. source,published")
+	flag.StringVar(&f.DateField, "date_field", "published", "Meta field holding the publication date of a document, used to order provenance.")
+	flag.DurationVar(&f.QueueLease, "queue_lease", 5*time.Minute, "How long a started queue item is leased to a worker before it is requeued.")
+	flag.IntVar(&f.QueueConcurrency, "queue_concurrency", 10, "Maximum number of queue items a worker runs at once.")
+	flag.DurationVar(&f.QueueRetention, "queue_retention", 7*24*time.Hour, "How long completed queue items are kept before being purged. Zero disables purging.")
+	flag.Var(&f.Indexes, "indexes", "Semicolon-separated list of additional indexes in the form name:window_size:hash_width:address,address")
 }
 
 func parseMode() string {
@@ -81,7 +111,7 @@ func parseMode() string {
 		return "posting"
 	case "queue":
 		return "queue"
-	case "add", "delete", "associate", "switch", "search":
+	case "add", "delete", "associate", "switch", "search", "compare":
 		return "client"
 	}
 	return "standalone"
@@ -93,52 +123,127 @@ func (r *Registry) Open() {
 	r.WindowSize = uint64(r.flags.WindowSize)
 	r.ApiAddress = r.flags.ApiAddress
 	r.Feeds = r.flags.Feeds
+	r.DateField = r.flags.DateField
+	r.QueueLease = r.flags.QueueLease
+	if r.QueueLease <= 0 {
+		glog.Fatalf("Queue lease must be positive: %s", r.QueueLease)
+	}
+	r.QueueConcurrency = r.flags.QueueConcurrency
+	r.QueueRetention = r.flags.QueueRetention
+	if r.QueueConcurrency <= 0 {
+		glog.Fatalf("Queue concurrency must be positive: %d", r.QueueConcurrency)
+	}
+	hostname, _ := os.Hostname()
+	r.WorkerId = fmt.Sprintf("%s:%d", hostname, os.Getpid())
 	if r.session, err = mgo.Dial(r.flags.MongoUrl); err != nil {
 		glog.Fatalf("Error connecting to mongo instance: %s", err)
 	}
 	if err := r.session.DB("").C("documents").EnsureIndexKey("_id.doctype", "_id.docid"); err != nil {
 		glog.Fatalf("Error creating index: %s", err)
 	}
-	if err := r.session.DB("").C("queue").EnsureIndexKey("status", "_id"); err != nil {
+	if err := r.session.DB("").C("documents").EnsureIndexKey("bands"); err != nil {
+		glog.Fatalf("Error creating index: %s", err)
+	}
+	for _, field := range r.flags.MetaIndexes {
+		if err := r.session.DB("").C("documents").EnsureIndexKey("meta." + field); err != nil {
+			glog.Fatalf("Error creating index: %s", err)
+		}
+	}
+	if err := r.session.DB("").C("queue").EnsureIndexKey("status", "priority", "_id"); err != nil {
+		glog.Fatalf("Error creating index: %s", err)
+	}
+	if err := r.session.DB("").C("queue").EnsureIndexKey("status", "lease"); err != nil {
+		glog.Fatalf("Error creating index: %s", err)
+	}
+	if err := r.session.DB("").C("queue").EnsureIndexKey("status", "finished"); err != nil {
+		glog.Fatalf("Error creating index: %s", err)
+	}
+	if err := r.session.DB("").C("queue").EnsureIndexKey("command", "_id"); err != nil {
+		glog.Fatalf("Error creating index: %s", err)
+	}
+	if err := r.session.DB("").C("queue").EnsureIndexKey("target.doctype", "target.docid"); err != nil {
+		glog.Fatalf("Error creating index: %s", err)
+	}
+	if err := r.session.DB("").C("theme").EnsureIndexKey("-count", "-length"); err != nil {
 		glog.Fatalf("Error creating index: %s", err)
 	}
+	if err := r.session.DB("").C("theme_documents").EnsureIndexKey("_id.theme"); err != nil {
+		glog.Fatalf("Error creating index: %s", err)
+	}
+	if err := r.session.DB("").C("associations").EnsureIndexKey("_id.target.doctype", "_id.target.docid"); err != nil {
+		glog.Fatalf("Error creating index: %s", err)
+	}
+	if err := r.session.DB("").C("associations").EnsureIndexKey("fragments.id"); err != nil {
+		glog.Fatalf("Error creating index: %s", err)
+	}
+	if err := r.session.DB("").C("clusters").EnsureIndexKey("range", "members"); err != nil {
+		glog.Fatalf("Error creating index: %s", err)
+	}
+	if err := r.session.DB("").C("clusters").EnsureIndexKey("members"); err != nil {
+		glog.Fatalf("Error creating index: %s", err)
+	}
+	r.Indexes = append([]IndexConfig{{
+		Name:       DefaultIndex,
+		WindowSize: r.WindowSize,
+		HashWidth:  r.HashWidth,
+		Addresses:  r.flags.PostingAddresses,
+	}}, r.flags.Indexes...)
 	if r.Mode == "posting" || r.Mode == "standalone" {
-		r.PostingListeners = make([]net.Listener, len(r.flags.PostingAddresses))
-		for i, postingAddress := range r.flags.PostingAddresses {
-			r.PostingListeners[i], err = net.Listen("tcp", postingAddress)
-			checkErr(err)
+		for _, index := range r.Indexes {
+			for _, postingAddress := range index.Addresses {
+				l, err := net.Listen("tcp", postingAddress)
+				checkErr(err)
+				r.PostingListeners = append(r.PostingListeners, l)
+			}
 		}
 	}
 	if r.Mode == "api" || r.Mode == "standalone" {
 		r.ApiListener, err = net.Listen("tcp", r.flags.ApiAddress)
 		checkErr(err)
-		size := (uint64(1) << r.HashWidth) / uint64(len(r.flags.PostingAddresses))
-		for i, postingAddress := range r.flags.PostingAddresses {
-			p := PostingConfig{
-				HashWidth:    uint64(r.flags.HashWidth),
-				WindowSize:   uint64(r.flags.WindowSize),
-				Size:         size,
-				Offset:       size * uint64(i),
-				GroupSize:    uint64(r.flags.GroupSize),
-				InitialQuery: r.flags.InitialQuery.String(),
-				Address:      postingAddress,
+	}
+	if r.Mode == "api" || r.Mode == "standalone" || r.Mode == "queue" {
+		for _, index := range r.Indexes {
+			size := (uint64(1) << index.HashWidth) / uint64(len(index.Addresses))
+			for i, postingAddress := range index.Addresses {
+				p := PostingConfig{
+					Index:        index.Name,
+					HashWidth:    index.HashWidth,
+					WindowSize:   index.WindowSize,
+					Size:         size,
+					Offset:       size * uint64(i),
+					GroupSize:    uint64(r.flags.GroupSize),
+					InitialQuery: r.flags.InitialQuery.String(),
+					Address:      postingAddress,
+				}
+				r.PostingConfigs = append(r.PostingConfigs, p)
 			}
-			r.PostingConfigs = append(r.PostingConfigs, p)
 		}
 	}
 }
 
+// An empty name returns the index configured by the window_size, hash_width
+// and posting_addresses flags.
+func (r *Registry) Index(name string) (*IndexConfig, error) {
+	if name == "" {
+		name = DefaultIndex
+	}
+	for i := range r.Indexes {
+		if r.Indexes[i].Name == name {
+			return &r.Indexes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown index: %s", name)
+}
+
 func (r *Registry) Close() {
 	if r.Mode == "standalone" || r.Mode == "api" {
 		checkErr(r.ApiListener.Close())
 	}
-	if r.Mode == "standalone" || r.Mode == "queue" {
-		if r.Queue != nil {
-			r.Queue <- true
-		}
+	if r.Queue != nil {
+		r.Queue <- true
 	}
 	if r.Mode == "standalone" || r.Mode == "posting" {
-		for i, _ := range r.flags.PostingAddresses {
+		for i, _ := range r.PostingListeners {
 			checkErr(r.PostingListeners[i].Close())
 		}
 	}
@@ -1,7 +1,9 @@
 package registry
 
 import (
+	"flag"
 	. "launchpad.net/gocheck"
+	"os"
 	"testing"
 )
 
@@ -12,16 +14,51 @@ type RegistrySuite struct{}
 var _ = Suite(&RegistrySuite{})
 
 func (s *RegistrySuite) TestNewRegistry(c *C) {
-	defaults := NewRegistry([]string{""})
+	args := os.Args
+	defer func() {
+		os.Args = args
+		flag.Set("hash_width", "24")
+		flag.Set("window_size", "30")
+	}()
+	os.Args = []string{"superfastmatch"}
+	defaults := NewRegistry()
+	c.Check(defaults.Mode, Equals, "standalone")
 	defaults.Open()
 	c.Check(defaults.session, NotNil)
 	c.Check(defaults.HashWidth, Equals, uint64(24))
 	c.Check(defaults.WindowSize, Equals, uint64(30))
 	defaults.Close()
-	r := NewRegistry([]string{"api", "-hash_width=32", "-window_size=40"})
+	os.Args = []string{"superfastmatch", "api"}
+	c.Assert(flag.Set("hash_width", "32"), IsNil)
+	c.Assert(flag.Set("window_size", "40"), IsNil)
+	r := NewRegistry()
+	c.Check(r.Mode, Equals, "api")
 	r.Open()
 	c.Check(r.session, NotNil)
 	c.Check(r.HashWidth, Equals, uint64(32))
 	c.Check(r.WindowSize, Equals, uint64(40))
 	r.Close()
 }
+
+func (s *RegistrySuite) TestIndexes(c *C) {
+	var x indexes
+	c.Assert(x.Set("quotes:15:24:127.0.0.1:8092,127.0.0.1:8093;passages:50:32:127.0.0.1:8094"), IsNil)
+	c.Check(x, DeepEquals, indexes{
+		{"quotes", 15, 24, []string{"127.0.0.1:8092", "127.0.0.1:8093"}},
+		{"passages", 50, 32, []string{"127.0.0.1:8094"}},
+	})
+	c.Check(x.String(), Equals, "quotes:15:24:127.0.0.1:8092,127.0.0.1:8093;passages:50:32:127.0.0.1:8094")
+	for _, bad := range []string{"quotes:15:24", "default:15:24:127.0.0.1:8092", "quotes:4:24:127.0.0.1:8092", "quotes:x:24:127.0.0.1:8092", "q:15:24:a,b,c"} {
+		var y indexes
+		c.Check(y.Set(bad), NotNil, Commentf(bad))
+	}
+	r := &Registry{Indexes: []IndexConfig{{Name: DefaultIndex}, x[0]}}
+	index, err := r.Index("")
+	c.Assert(err, IsNil)
+	c.Check(index.Name, Equals, DefaultIndex)
+	index, err = r.Index("quotes")
+	c.Assert(err, IsNil)
+	c.Check(index.WindowSize, Equals, uint64(15))
+	_, err = r.Index("missing")
+	c.Check(err, NotNil)
+}
@@ -14,6 +14,8 @@ type windowSize int
 type groupSize uint64
 type addresses []string
 type query string
+type fields []string
+type indexes []IndexConfig
 
 func checkErr(err error) {
 	if err != nil {
@@ -97,3 +99,62 @@ func (q *query) Set(value string) error {
 func (q *query) String() string {
 	return string(*q)
 }
+
+func (f *fields) Set(value string) error {
+	for _, field := range strings.Split(value, ",") {
+		if field == "" || strings.ContainsAny(field, "$ ") {
+			return errors.New("Fields must be a comma-separated list of names")
+		}
+		*f = append(*f, field)
+	}
+	return nil
+}
+
+func (f *fields) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Parses name:window_size:hash_width:address,address;...
+func (x *indexes) Set(value string) error {
+	for _, section := range strings.Split(value, ";") {
+		parts := strings.SplitN(section, ":", 4)
+		if len(parts) != 4 || parts[0] == "" || parts[0] == DefaultIndex {
+			return errors.New("Indexes must be in the form name:window_size:hash_width:address,address")
+		}
+		for _, index := range *x {
+			if index.Name == parts[0] {
+				return errors.New(fmt.Sprintf("Index %s is specified more than once", parts[0]))
+			}
+		}
+		var w windowSize
+		var h hashWidth
+		var a addresses
+		if err := w.Set(parts[1]); err != nil {
+			return err
+		}
+		if err := h.Set(parts[2]); err != nil {
+			return err
+		}
+		if err := a.Set(parts[3]); err != nil {
+			return err
+		}
+		if w == 0 || h == 0 {
+			return errors.New(fmt.Sprintf("Index %s must have a numeric window size and hash width", parts[0]))
+		}
+		*x = append(*x, IndexConfig{
+			Name:       parts[0],
+			WindowSize: uint64(w),
+			HashWidth:  uint64(h),
+			Addresses:  a,
+		})
+	}
+	return nil
+}
+
+func (x *indexes) String() string {
+	sections := make([]string, len(*x))
+	for i, index := range *x {
+		sections[i] = fmt.Sprintf("%s:%d:%d:%s", index.Name, index.WindowSize, index.HashWidth, strings.Join(index.Addresses, ","))
+	}
+	return strings.Join(sections, ";")
+}
@@ -61,6 +61,21 @@ func Init(size uint64, groupSize uint64) *SparseTable {
 	}
 }
 
+// Returns a deep copy which can be altered independently of the original
+func (s *SparseTable) Copy() *SparseTable {
+	c := &SparseTable{
+		groupSize: s.groupSize,
+		lengths:   make([]uint8, len(s.lengths)),
+		groups:    make([][]byte, len(s.groups)),
+		buffer:    make([]byte, MAX_SIZE),
+	}
+	copy(c.lengths, s.lengths)
+	for i := range s.groups {
+		c.groups[i] = append([]byte(nil), s.groups[i]...)
+	}
+	return c
+}
+
 func (s *SparseTable) getOffsets(pos uint64) (uint64, uint64, uint64) {
 	group := pos / s.groupSize
 	start := FastSumUint8(s.lengths[group*s.groupSize : pos])
@@ -130,6 +130,23 @@ func Test_SparseTable(t *testing.T) {
 	}
 }
 
+func Test_SparseTableCopy(t *testing.T) {
+	A := Init(1024, 48)
+	A.SetBytes(1, []byte("original"))
+	B := A.Copy()
+	B.SetBytes(1, []byte("copy"))
+	B.SetBytes(2, []byte("added"))
+	if value, _ := A.GetBytes(1); string(value) != "original" {
+		t.Error("Original altered by copy.")
+	}
+	if A.Count() != 1 || B.Count() != 2 {
+		t.Error("Incorrect Count.")
+	}
+	if value, _ := B.GetBytes(1); string(value) != "copy" {
+		t.Error("Could not get value from copy.")
+	}
+}
+
 func Test_DifferentSizeSparseTables(t *testing.T) {
 	A := Init(5, 2)
 	A.SetBytes(0, []byte("First is a long string!"))
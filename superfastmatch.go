@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"syscall"
 )
 
 func main() {
@@ -25,11 +26,16 @@ func main() {
 	defer registry.Close()
 	glog.Infof("Started in %v mode with Hash Width: %v and Window Size: %v", registry.Mode, registry.HashWidth, registry.WindowSize)
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	go http.ListenAndServe("localhost:6060", nil)
+	if registry.Mode != "posting" {
+		registry.Queue = make(chan bool)
+	}
 	switch registry.Mode {
 	case "posting":
 		posting.Serve(registry)
+	case "queue":
+		go queue.Start(registry)
 	case "api":
 		go queue.Start(registry)
 		go api.MonitorFeeds(registry)